@@ -3,6 +3,7 @@ package boot
 import (
 	"context"
 	"encoding/json"
+	"expvar"
 	"flag"
 	"net/http"
 	"os"
@@ -15,12 +16,14 @@ import (
 
 var configFile string
 var pprofEnabled bool
+var adminAddr string
 var logLevel int
 
 //nolint:gosec
 func InitAndStart(ctx context.Context) error {
 	flag.StringVar(&configFile, "config", "config.json", "config file path")
-	flag.BoolVar(&pprofEnabled, "pprof", false, "run pprof on 6060 port")
+	flag.BoolVar(&pprofEnabled, "pprof", false, "run pprof and expvar on 6060 port")
+	flag.StringVar(&adminAddr, "admin", "", "address of admin server with sticky tables, like 127.0.0.1:6061 (disabled by default)")
 	flag.IntVar(&logLevel, "loglevel", 3, "log level: 0-4 (debug - fatal), 7 - disabled")
 	flag.Parse()
 
@@ -43,6 +46,27 @@ func InitAndStart(ctx context.Context) error {
 		return errors.Wrap(err, "NewProxy()")
 	}
 
+	expvar.Publish("dispatcher", expvar.Func(func() any {
+		return proxy.DispatcherStats()
+	}))
+	expvar.Publish("reactors", expvar.Func(func() any {
+		return proxy.ReactorLoads()
+	}))
+	expvar.Publish("backends", expvar.Func(func() any {
+		return proxy.BackendStats()
+	}))
+
+	// admin server is separated from pprof, because it changes the state of the proxy
+	if adminAddr != "" {
+		adminMux := http.NewServeMux()
+		adminMux.HandleFunc("/debug/sticky", stickyHandler(proxy))
+		go func() {
+			if err := http.ListenAndServe(adminAddr, adminMux); err != nil {
+				logger.Error().Err(err).Msg("admin server failed")
+			}
+		}()
+	}
+
 	if pprofEnabled {
 		go func() {
 			if err := http.ListenAndServe(":6060", nil); err != nil {
@@ -51,8 +75,32 @@ func InitAndStart(ctx context.Context) error {
 		}()
 	}
 
-	// here proxy blocks the main routine until ctx cancelled.
-	proxy.Run()
+	// here proxy blocks the main routine until ctx cancelled or the proxy failed.
+	err = proxy.Run()
+	if err != nil {
+		return errors.Wrap(err, "Run()")
+	}
 
 	return nil
 }
+
+// stickyHandler returns sticky tables of apps on GET request.
+// DELETE request with "app" query parameter clears the sticky table of the app, or only the entry of "client" IP if it is set.
+func stickyHandler(proxy service.Proxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			_ = json.NewEncoder(w).Encode(proxy.StickyEntries())
+		case http.MethodDelete:
+			removed, err := proxy.ClearSticky(r.URL.Query().Get("app"), r.URL.Query().Get("client"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]int{"removed": removed})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -1,24 +1,208 @@
 package boot
 
-import "github.com/hotafrika/tcp_proxy_epoll/service"
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/hotafrika/tcp_proxy_epoll/service"
+)
 
 type Config struct {
-	Apps []App `json:"Apps"`
+	Apps          []App      `json:"Apps"`
+	Poller        string     `json:"Poller"`
+	EdgeTriggered bool       `json:"EdgeTriggered"`
+	Reactors      Reactors   `json:"Reactors"`
+	Dispatcher    Dispatcher `json:"Dispatcher"`
+}
+
+type Reactors struct {
+	Count  int    `json:"Count"`
+	Assign string `json:"Assign"`
+}
+
+type Dispatcher struct {
+	Workers   int    `json:"Workers"`
+	QueueSize int    `json:"QueueSize"`
+	Overflow  string `json:"Overflow"`
 }
 
 type App struct {
-	Name    string   `json:"Name"`
-	Ports   []int    `json:"Ports"`
-	Targets []string `json:"Targets"`
+	Name           string      `json:"Name"`
+	Ports          []int       `json:"Ports"`
+	Targets        []Target    `json:"Targets"`
+	MinHealthy     int         `json:"MinHealthy"`
+	Relay          string      `json:"Relay"`
+	Balancer       string      `json:"Balancer"`
+	HashBy         string      `json:"HashBy"`
+	Sticky         Sticky      `json:"Sticky"`
+	Retry          Retry       `json:"Retry"`
+	Queue          Queue       `json:"Queue"`
+	SlowStart      Duration    `json:"SlowStart"`
+	ConnectTimeout Duration    `json:"ConnectTimeout"`
+	Healthcheck    Healthcheck `json:"Healthcheck"`
+	Listeners      int         `json:"Listeners"`
+}
+
+type Sticky struct {
+	TTL     Duration `json:"TTL"`
+	MaxSize int      `json:"MaxSize"`
+}
+
+type Retry struct {
+	Attempts     int      `json:"Attempts"`
+	ExcludeTried bool     `json:"ExcludeTried"`
+	Backoff      Duration `json:"Backoff"`
+	Deadline     Duration `json:"Deadline"`
+}
+
+type Queue struct {
+	Size    int      `json:"Size"`
+	Timeout Duration `json:"Timeout"`
+}
+
+// Duration is time.Duration which is written in the config file as the string like "1m30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// Target is the backend of the app. In the config file it is either the address string or the object with "Address" and optional "Weight".
+type Target struct {
+	Address string `json:"Address"`
+	// Weight is 1 if it is omitted.
+	Weight         *int        `json:"Weight"`
+	Priority       int         `json:"Priority"`
+	MaxConnections int         `json:"MaxConnections"`
+	Healthcheck    Healthcheck `json:"Healthcheck"`
+}
+
+type Healthcheck struct {
+	Type     string      `json:"Type"`
+	HTTP     HTTPCheck   `json:"HTTP"`
+	Script   []CheckStep `json:"Script"`
+	Interval Duration    `json:"Interval"`
+	Timeout  Duration    `json:"Timeout"`
+	Jitter   Duration    `json:"Jitter"`
+	Rise     int         `json:"Rise"`
+	Fall     int         `json:"Fall"`
+}
+
+type HTTPCheck struct {
+	Method       string            `json:"Method"`
+	Path         string            `json:"Path"`
+	Headers      map[string]string `json:"Headers"`
+	ExpectStatus string            `json:"ExpectStatus"`
+	ExpectBody   string            `json:"ExpectBody"`
+}
+
+type CheckStep struct {
+	Send        string   `json:"Send"`
+	Expect      string   `json:"Expect"`
+	ExpectRegex string   `json:"ExpectRegex"`
+	Timeout     Duration `json:"Timeout"`
+}
+
+func (h Healthcheck) toConfig() service.ConfigHealthcheck {
+	var script []service.ConfigCheckStep
+	for _, step := range h.Script {
+		script = append(script, service.ConfigCheckStep{
+			Send:        step.Send,
+			Expect:      step.Expect,
+			ExpectRegex: step.ExpectRegex,
+			Timeout:     time.Duration(step.Timeout),
+		})
+	}
+	return service.ConfigHealthcheck{
+		Type: h.Type,
+		HTTP: service.ConfigHTTPCheck{
+			Method:       h.HTTP.Method,
+			Path:         h.HTTP.Path,
+			Headers:      h.HTTP.Headers,
+			ExpectStatus: h.HTTP.ExpectStatus,
+			ExpectBody:   h.HTTP.ExpectBody,
+		},
+		Script:   script,
+		Interval: time.Duration(h.Interval),
+		Timeout:  time.Duration(h.Timeout),
+		Jitter:   time.Duration(h.Jitter),
+		Rise:     h.Rise,
+		Fall:     h.Fall,
+	}
+}
+
+func (t *Target) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte(`"`)) {
+		*t = Target{}
+		return json.Unmarshal(b, &t.Address)
+	}
+	type target Target
+	return json.Unmarshal(b, (*target)(t))
 }
 
 func (c Config) toProxyConfig() service.ProxyConfig {
-	var proxyConfig service.ProxyConfig
+	proxyConfig := service.ProxyConfig{
+		Poller:        c.Poller,
+		EdgeTriggered: c.EdgeTriggered,
+		Reactors: service.ConfigReactors{
+			Count:  c.Reactors.Count,
+			Assign: c.Reactors.Assign,
+		},
+		Dispatcher: service.ConfigDispatcher{
+			Workers:   c.Dispatcher.Workers,
+			QueueSize: c.Dispatcher.QueueSize,
+			Overflow:  c.Dispatcher.Overflow,
+		},
+	}
 	for _, app := range c.Apps {
 		configApp := service.ConfigApp{
-			Name:    app.Name,
-			Ports:   app.Ports,
-			Targets: app.Targets,
+			Name:       app.Name,
+			Ports:      app.Ports,
+			MinHealthy: app.MinHealthy,
+			Relay:      app.Relay,
+			Balancer:   app.Balancer,
+			HashBy:     app.HashBy,
+			Sticky: service.ConfigSticky{
+				TTL:     time.Duration(app.Sticky.TTL),
+				MaxSize: app.Sticky.MaxSize,
+			},
+			Retry: service.ConfigRetry{
+				Attempts:     app.Retry.Attempts,
+				ExcludeTried: app.Retry.ExcludeTried,
+				Backoff:      time.Duration(app.Retry.Backoff),
+				Deadline:     time.Duration(app.Retry.Deadline),
+			},
+			Queue: service.ConfigQueue{
+				Size:    app.Queue.Size,
+				Timeout: time.Duration(app.Queue.Timeout),
+			},
+			SlowStart:      time.Duration(app.SlowStart),
+			ConnectTimeout: time.Duration(app.ConnectTimeout),
+			Healthcheck:    app.Healthcheck.toConfig(),
+			Listeners:      app.Listeners,
+		}
+		for _, target := range app.Targets {
+			configTarget := service.ConfigTarget{
+				Address:        target.Address,
+				Weight:         1,
+				Priority:       target.Priority,
+				MaxConnections: target.MaxConnections,
+				Healthcheck:    target.Healthcheck.toConfig(),
+			}
+			if target.Weight != nil {
+				configTarget.Weight = *target.Weight
+			}
+			configApp.Targets = append(configApp.Targets, configTarget)
 		}
 		proxyConfig.Apps = append(proxyConfig.Apps, configApp)
 	}
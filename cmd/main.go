@@ -22,6 +22,7 @@ func main() {
 	if err != nil {
 		err = errors.Wrap(err, "InitAndStart()")
 		_, _ = fmt.Fprintf(os.Stderr, "%v", err)
-		return
+		cancel()
+		os.Exit(1)
 	}
 }
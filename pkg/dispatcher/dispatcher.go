@@ -0,0 +1,117 @@
+package dispatcher
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Overflow defines what Dispatcher does with a task when its queue is full.
+type Overflow int
+
+const (
+	// Block makes the submitter wait until the queue has free space.
+	Block Overflow = iota
+	// CallerRuns executes the task in the submitter goroutine.
+	CallerRuns
+)
+
+// ParseOverflow converts overflow policy name to Overflow. Empty name means Block.
+func ParseOverflow(name string) (Overflow, error) {
+	switch name {
+	case "", "block":
+		return Block, nil
+	case "caller-runs":
+		return CallerRuns, nil
+	default:
+		return 0, errors.Errorf("unknown overflow policy %q", name)
+	}
+}
+
+// Dispatcher executes tasks with the fixed number of worker goroutines.
+// Tasks wait for free workers in the bounded queue.
+type Dispatcher struct {
+	ctx       context.Context
+	tasks     chan func()
+	workers   int
+	overflow  Overflow
+	busy      atomic.Int64
+	overflows atomic.Uint64
+}
+
+// Stats is the snapshot of Dispatcher state.
+type Stats struct {
+	Workers     int
+	BusyWorkers int
+	QueueSize   int
+	QueueDepth  int
+	// Overflows is the number of tasks that were submitted to the full queue.
+	Overflows uint64
+}
+
+// New creates Dispatcher and starts its workers. Workers exit when ctx is done.
+func New(ctx context.Context, workers, queueSize int, overflow Overflow) (*Dispatcher, error) {
+	if workers <= 0 {
+		return nil, errors.New("workers count must be positive")
+	}
+	if queueSize < 0 {
+		return nil, errors.New("queue size must not be negative")
+	}
+	d := &Dispatcher{
+		ctx:      ctx,
+		tasks:    make(chan func(), queueSize),
+		workers:  workers,
+		overflow: overflow,
+	}
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+	return d, nil
+}
+
+// Submit queues the task for execution. It returns false if the task was not accepted because ctx is done.
+func (d *Dispatcher) Submit(task func()) bool {
+	select {
+	case d.tasks <- task:
+		return true
+	default:
+	}
+
+	d.overflows.Add(1)
+	if d.overflow == CallerRuns {
+		task()
+		return true
+	}
+	select {
+	case d.tasks <- task:
+		return true
+	case <-d.ctx.Done():
+		return false
+	}
+}
+
+// Stats returns current Dispatcher stats.
+func (d *Dispatcher) Stats() Stats {
+	return Stats{
+		Workers:     d.workers,
+		BusyWorkers: int(d.busy.Load()),
+		QueueSize:   cap(d.tasks),
+		QueueDepth:  len(d.tasks),
+		Overflows:   d.overflows.Load(),
+	}
+}
+
+// work is a blocking function. It executes tasks from the queue until ctx is done.
+func (d *Dispatcher) work() {
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case task := <-d.tasks:
+			d.busy.Add(1)
+			task()
+			d.busy.Add(-1)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package dispatcher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// busyDispatcher creates Dispatcher with one worker and the queue of one task, and fills both of them.
+// The worker is blocked until the returned release func is called.
+func busyDispatcher(t *testing.T, ctx context.Context, overflow Overflow) (*Dispatcher, func()) {
+	t.Helper()
+	d, err := New(ctx, 1, 1, overflow)
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	started := make(chan struct{})
+	blocked := make(chan struct{})
+	d.Submit(func() {
+		close(started)
+		<-blocked
+	})
+	<-started
+	d.Submit(func() {})
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			close(blocked)
+		})
+	}
+	t.Cleanup(release)
+	return d, release
+}
+
+func TestParseOverflow(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Overflow
+		wantErr bool
+	}{
+		{name: "", want: Block},
+		{name: "block", want: Block},
+		{name: "caller-runs", want: CallerRuns},
+		{name: "drop", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseOverflow(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseOverflow(%q) = %v, %v, want %v, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(context.Background(), 0, 1, Block); err == nil {
+		t.Error("New() without workers didn't fail")
+	}
+	if _, err := New(context.Background(), 1, -1, Block); err == nil {
+		t.Error("New() with negative queue size didn't fail")
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d, err := New(ctx, 4, 16, Block)
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		if !d.Submit(wg.Done) {
+			t.Fatal("Submit() = false")
+		}
+	}
+	wg.Wait()
+}
+
+func TestBlockOverflow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d, release := busyDispatcher(t, ctx, Block)
+	if s := d.Stats(); s.BusyWorkers != 1 || s.QueueDepth != 1 {
+		t.Fatalf("Stats() = %+v, want busy worker and full queue", s)
+	}
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- d.Submit(func() {})
+	}()
+	select {
+	case <-done:
+		t.Fatal("Submit() to the full queue didn't block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("Submit() = false, want true")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Submit() is blocked after the queue has free space")
+	}
+	if s := d.Stats(); s.Overflows != 1 {
+		t.Errorf("Stats().Overflows = %d, want 1", s.Overflows)
+	}
+}
+
+func TestBlockOverflowDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d, _ := busyDispatcher(t, ctx, Block)
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- d.Submit(func() {})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("Submit() = true after ctx is done, want false")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Submit() is blocked after ctx is done")
+	}
+}
+
+func TestCallerRunsOverflow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d, _ := busyDispatcher(t, ctx, CallerRuns)
+
+	// the task is executed by Submit itself, so it is done when Submit returns
+	ran := false
+	if !d.Submit(func() { ran = true }) {
+		t.Fatal("Submit() = false, want true")
+	}
+	if !ran {
+		t.Error("the task wasn't executed by the caller")
+	}
+	if s := d.Stats(); s.Overflows != 1 || s.QueueDepth != 1 {
+		t.Errorf("Stats() = %+v, want 1 overflow and the full queue", s)
+	}
+}
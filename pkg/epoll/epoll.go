@@ -3,6 +3,9 @@
 package epoll
 
 import (
+	"context"
+
+	"github.com/hotafrika/tcp_proxy_epoll/pkg/poller"
 	"github.com/pkg/errors"
 )
 
@@ -10,11 +13,25 @@ import (
 type Epoll struct {
 }
 
-func New() (*Epoll, error) {
+var _ poller.Poller = (*Epoll)(nil)
+
+func New(mode Mode) (*Epoll, error) {
 	return nil, errors.New("it works only in Linux systems")
 }
 
-func (e *Epoll) Add(fd int) error {
+func (e *Epoll) Mode() Mode {
+	return LevelTriggered
+}
+
+func (e *Epoll) Add(fd int, interest poller.Interest) error {
+	return nil
+}
+
+func (e *Epoll) Mod(fd int, interest poller.Interest) error {
+	return nil
+}
+
+func (e *Epoll) Rearm(fd int, interest poller.Interest) error {
 	return nil
 }
 
@@ -26,6 +43,14 @@ func (e *Epoll) Close() error {
 	return nil
 }
 
-func (e *Epoll) Wait() ([]int, error) {
+func (e *Epoll) Wait() ([]poller.Event, error) {
+	return nil, nil
+}
+
+func (e *Epoll) WaitContext(ctx context.Context) ([]poller.Event, error) {
 	return nil, nil
 }
+
+func (e *Epoll) Wake() error {
+	return nil
+}
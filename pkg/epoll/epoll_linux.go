@@ -3,41 +3,118 @@
 package epoll
 
 import (
+	"context"
+	"encoding/binary"
+	"sync"
 	"syscall"
 
+	"github.com/hotafrika/tcp_proxy_epoll/pkg/poller"
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 )
 
-// Epoll is a simple wrapper for unix epoll .
+// Epoll is a simple wrapper for unix epoll . It implements poller.Poller.
+// It owns eventfd registered in the epoll, so Wait can be interrupted with Wake.
 type Epoll struct {
-	fd int
+	fd     int
+	wakeFd int
+	mode   Mode
+
+	// cmu protects fds from usage after Close.
+	cmu    sync.RWMutex
+	closed chan struct{}
+
+	watchMu sync.Mutex
+	watched context.Context
 }
 
-func New() (*Epoll, error) {
-	fd, err := unix.EpollCreate1(0)
+var _ poller.Poller = (*Epoll)(nil)
+
+func New(mode Mode) (*Epoll, error) {
+	fd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
 	if err != nil {
 		return nil, errors.Wrap(err, "EpollCreate1()")
 	}
+	wakeFd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrap(err, "Eventfd()")
+	}
+	err = unix.EpollCtl(fd, syscall.EPOLL_CTL_ADD, wakeFd, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(wakeFd)})
+	if err != nil {
+		unix.Close(wakeFd)
+		unix.Close(fd)
+		return nil, errors.Wrap(err, "EpollCtl()")
+	}
 	return &Epoll{
-		fd: fd,
+		fd:     fd,
+		wakeFd: wakeFd,
+		mode:   mode,
+		closed: make(chan struct{}),
 	}, nil
 }
 
-// Add adds fd to epoll.
+// Mode returns the registration mode of the epoll.
+func (e *Epoll) Mode() Mode {
+	return e.mode
+}
+
+// Add adds fd to epoll with the Interest.
 // EPOLLIN - associated with fd file is ready for read .
+// EPOLLOUT - associated with fd file is ready for write .
 // EPOLLHUP - hang up happened on the associated file descriptor.
 // EPOLLRDHUP - stream socket peer closed connection, or shut down writing half of connection.
-// EPOLLET requests edge-triggered notification for the associated file descriptor .
-func (e *Epoll) Add(fd int) error {
-	// err := unix.EpollCtl(e.fd, syscall.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: unix.EPOLLIN | unix.EPOLLHUP | unix.EPOLLRDHUP | unix.EPOLLET, Fd: int32(fd)})
-	err := unix.EpollCtl(e.fd, syscall.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: unix.EPOLLIN | unix.EPOLLHUP | unix.EPOLLRDHUP, Fd: int32(fd)})
+// EPOLLONESHOT disables the associated file descriptor after the first event (OneShot interest only).
+// EPOLLEXCLUSIVE wakes up only one (or some) of epoll instances with the associated file descriptor (Exclusive interest only).
+// EPOLLET requests edge-triggered notification for the associated file descriptor (EdgeTriggered mode only).
+func (e *Epoll) Add(fd int, interest poller.Interest) error {
+	err := unix.EpollCtl(e.fd, syscall.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: e.events(interest), Fd: int32(fd)})
+	if err != nil {
+		return errors.Wrap(err, "EpollCtl()")
+	}
+	return nil
+}
+
+// Mod changes the Interest of the registered fd.
+func (e *Epoll) Mod(fd int, interest poller.Interest) error {
+	err := unix.EpollCtl(e.fd, syscall.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Events: e.events(interest), Fd: int32(fd)})
 	if err != nil {
 		return errors.Wrap(err, "EpollCtl()")
 	}
 	return nil
 }
 
+// Rearm enables the disabled EPOLLONESHOT fd again. The kernel checks fd readiness right away,
+// so readiness which came while fd was disabled is not lost.
+func (e *Epoll) Rearm(fd int, interest poller.Interest) error {
+	return e.Mod(fd, interest|poller.OneShot)
+}
+
+// events converts Interest to epoll events according to the epoll mode.
+func (e *Epoll) events(interest poller.Interest) uint32 {
+	events := uint32(unix.EPOLLHUP)
+	if interest&poller.Readable != 0 {
+		events |= unix.EPOLLIN
+		// EPOLLEXCLUSIVE can't be combined with EPOLLRDHUP
+		if interest&poller.Exclusive == 0 {
+			events |= unix.EPOLLRDHUP
+		}
+	}
+	if interest&poller.Writable != 0 {
+		events |= unix.EPOLLOUT
+	}
+	if interest&poller.OneShot != 0 {
+		events |= unix.EPOLLONESHOT
+	}
+	if interest&poller.Exclusive != 0 {
+		events |= unix.EPOLLEXCLUSIVE
+	}
+	if e.mode == EdgeTriggered {
+		events |= unix.EPOLLET
+	}
+	return events
+}
+
 // Del deletes fd from epoll.
 func (e *Epoll) Del(fd int) error {
 	err := unix.EpollCtl(e.fd, syscall.EPOLL_CTL_DEL, fd, nil)
@@ -47,17 +124,51 @@ func (e *Epoll) Del(fd int) error {
 	return nil
 }
 
-// Close closes epoll fd.
+// Close closes epoll fd and its eventfd.
 func (e *Epoll) Close() error {
-	err := unix.Close(e.fd)
+	e.cmu.Lock()
+	defer e.cmu.Unlock()
+	select {
+	case <-e.closed:
+		return nil
+	default:
+	}
+	close(e.closed)
+
+	err := unix.Close(e.wakeFd)
+	if err != nil {
+		return errors.Wrap(err, "Close() eventfd")
+	}
+	err = unix.Close(e.fd)
 	if err != nil {
 		return errors.Wrap(err, "Close()")
 	}
 	return nil
 }
 
-// Wait returns FDs that received events.
-func (e *Epoll) Wait() ([]unix.EpollEvent, error) {
+// Wake interrupts the current or the next Wait.
+func (e *Epoll) Wake() error {
+	e.cmu.RLock()
+	defer e.cmu.RUnlock()
+	select {
+	case <-e.closed:
+		return errClosed
+	default:
+	}
+
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], 1)
+	_, err := unix.Write(e.wakeFd, b[:])
+	// EAGAIN means that the eventfd counter is full, so Wait will be interrupted anyway
+	if err != nil && err != unix.EAGAIN {
+		return errors.Wrap(err, "Write() eventfd")
+	}
+	return nil
+}
+
+// Wait returns FDs that received events. It blocks until new events or Wake.
+// It returns no events if it was interrupted by Wake.
+func (e *Epoll) Wait() ([]poller.Event, error) {
 	events := make([]unix.EpollEvent, 100)
 	var n int
 	var err error
@@ -73,9 +184,84 @@ func (e *Epoll) Wait() ([]unix.EpollEvent, error) {
 		break
 	}
 
-	return events[:n], nil
+	// eventfd events are not returned to the caller
+	result := make([]poller.Event, 0, n)
+	for _, event := range events[:n] {
+		if int(event.Fd) == e.wakeFd {
+			e.resetWake()
+			continue
+		}
+		result = append(result, poller.Event{Fd: int(event.Fd), Flags: flags(event.Events)})
+	}
+	return result, nil
+}
+
+// flags converts epoll events to poller.Flags.
+func flags(events uint32) poller.Flags {
+	var f poller.Flags
+	if events&unix.EPOLLIN != 0 {
+		f |= poller.In
+	}
+	if events&unix.EPOLLOUT != 0 {
+		f |= poller.Out
+	}
+	if events&unix.EPOLLRDHUP != 0 {
+		f |= poller.RdHup
+	}
+	if events&unix.EPOLLHUP != 0 {
+		f |= poller.Hup
+	}
+	if events&unix.EPOLLERR != 0 {
+		f |= poller.Err
+	}
+	return f
 }
 
+// WaitContext is like Wait, but it is also interrupted when ctx is done. In this case it returns ctx error.
+func (e *Epoll) WaitContext(ctx context.Context) ([]poller.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	e.watch(ctx)
+	events, err := e.Wait()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	return events, err
+}
+
+// watch starts goroutine which calls Wake when ctx is done.
+// Only one goroutine is started for the same ctx. It also exits on Close.
+func (e *Epoll) watch(ctx context.Context) {
+	if ctx.Done() == nil {
+		return
+	}
+	e.watchMu.Lock()
+	defer e.watchMu.Unlock()
+	if e.watched == ctx {
+		return
+	}
+	e.watched = ctx
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = e.Wake()
+		case <-e.closed:
+		}
+	}()
+}
+
+// resetWake resets eventfd counter.
+func (e *Epoll) resetWake() {
+	var b [8]byte
+	_, _ = unix.Read(e.wakeFd, b[:])
+}
+
+var (
+	errClosed = errors.New("epoll is closed")
+)
+
 // temporaryErr helps to check if err is temporary according to
 // https://cs.opensource.google/go/go/+/refs/tags/go1.19.4:src/syscall/syscall_unix.go;l=134 .
 func temporaryErr(err error) bool {
@@ -0,0 +1,246 @@
+//go:build linux
+
+package epoll
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hotafrika/tcp_proxy_epoll/pkg/poller"
+	"golang.org/x/sys/unix"
+)
+
+// newEpoll creates Epoll of the mode, which is closed after the test.
+func newEpoll(t *testing.T, mode Mode) *Epoll {
+	t.Helper()
+	e, err := New(mode)
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	t.Cleanup(func() {
+		e.Close()
+	})
+	return e
+}
+
+// socketPair returns connected non-blocking unix stream sockets, which are closed after the test.
+func socketPair(t *testing.T) (int, int) {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		t.Fatalf("Socketpair(): %v", err)
+	}
+	t.Cleanup(func() {
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+	})
+	return fds[0], fds[1]
+}
+
+// writeByte makes fd readable.
+func writeByte(t *testing.T, fd int) {
+	t.Helper()
+	if _, err := unix.Write(fd, []byte("x")); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+}
+
+// waitEvents returns events of WaitContext, or nil if there are no events before timeout.
+func waitEvents(t *testing.T, e *Epoll, timeout time.Duration) []poller.Event {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	events, err := e.WaitContext(ctx)
+	if err != nil && ctx.Err() == nil {
+		t.Fatalf("WaitContext(): %v", err)
+	}
+	return events
+}
+
+// hasEvent reports if events have the event of fd with flags.
+func hasEvent(events []poller.Event, fd int, flags poller.Flags) bool {
+	for _, event := range events {
+		if event.Fd == fd && event.Flags&flags == flags {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAddDel(t *testing.T) {
+	e := newEpoll(t, LevelTriggered)
+	a, b := socketPair(t)
+	if err := e.Add(a, poller.Readable); err != nil {
+		t.Fatalf("Add(): %v", err)
+	}
+	if err := e.Add(a, poller.Readable); err == nil {
+		t.Error("Add() of the registered fd didn't fail")
+	}
+	if events := waitEvents(t, e, 50*time.Millisecond); len(events) != 0 {
+		t.Errorf("WaitContext() = %v, want no events", events)
+	}
+	writeByte(t, b)
+	if events := waitEvents(t, e, time.Second); !hasEvent(events, a, poller.In) {
+		t.Errorf("WaitContext() = %v, want In event of %d", events, a)
+	}
+
+	if err := e.Del(a); err != nil {
+		t.Fatalf("Del(): %v", err)
+	}
+	if events := waitEvents(t, e, 50*time.Millisecond); len(events) != 0 {
+		t.Errorf("WaitContext() after Del() = %v, want no events", events)
+	}
+	if err := e.Del(a); err == nil {
+		t.Error("Del() of unknown fd didn't fail")
+	}
+}
+
+func TestModes(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  Mode
+		again bool
+	}{
+		{name: "level-triggered", mode: LevelTriggered, again: true},
+		{name: "edge-triggered", mode: EdgeTriggered, again: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEpoll(t, tt.mode)
+			if e.Mode() != tt.mode {
+				t.Errorf("Mode() = %v, want %v", e.Mode(), tt.mode)
+			}
+			a, b := socketPair(t)
+			if err := e.Add(a, poller.Readable); err != nil {
+				t.Fatalf("Add(): %v", err)
+			}
+			writeByte(t, b)
+			if events := waitEvents(t, e, time.Second); !hasEvent(events, a, poller.In) {
+				t.Fatalf("WaitContext() = %v, want In event of %d", events, a)
+			}
+			// the data isn't read, so only level-triggered fd is reported again
+			events := waitEvents(t, e, 50*time.Millisecond)
+			if got := hasEvent(events, a, poller.In); got != tt.again {
+				t.Fatalf("WaitContext() of unread fd = %v, want event %v", events, tt.again)
+			}
+			// new data is the new edge
+			writeByte(t, b)
+			if events := waitEvents(t, e, time.Second); !hasEvent(events, a, poller.In) {
+				t.Errorf("WaitContext() after new data = %v, want In event of %d", events, a)
+			}
+		})
+	}
+}
+
+func TestOneShotRearm(t *testing.T) {
+	for _, mode := range []Mode{LevelTriggered, EdgeTriggered} {
+		e := newEpoll(t, mode)
+		a, b := socketPair(t)
+		if err := e.Add(a, poller.Readable|poller.OneShot); err != nil {
+			t.Fatalf("Add(): %v", err)
+		}
+		writeByte(t, b)
+		if events := waitEvents(t, e, time.Second); !hasEvent(events, a, poller.In) {
+			t.Fatalf("mode %v: WaitContext() = %v, want In event of %d", mode, events, a)
+		}
+		// fd is disabled until Rearm, even if new data comes
+		writeByte(t, b)
+		if events := waitEvents(t, e, 50*time.Millisecond); len(events) != 0 {
+			t.Fatalf("mode %v: WaitContext() of disabled fd = %v, want no events", mode, events)
+		}
+		// the readiness which came while fd was disabled isn't lost
+		if err := e.Rearm(a, poller.Readable); err != nil {
+			t.Fatalf("Rearm(): %v", err)
+		}
+		if events := waitEvents(t, e, time.Second); !hasEvent(events, a, poller.In) {
+			t.Fatalf("mode %v: WaitContext() after Rearm() = %v, want In event of %d", mode, events, a)
+		}
+	}
+}
+
+func TestMod(t *testing.T) {
+	e := newEpoll(t, LevelTriggered)
+	a, _ := socketPair(t)
+	if err := e.Mod(a, poller.Readable); err == nil {
+		t.Error("Mod() of unknown fd didn't fail")
+	}
+	if err := e.Add(a, poller.Readable); err != nil {
+		t.Fatalf("Add(): %v", err)
+	}
+	// the socket buffer is empty, so fd is writable
+	if err := e.Mod(a, poller.Writable); err != nil {
+		t.Fatalf("Mod(): %v", err)
+	}
+	if events := waitEvents(t, e, time.Second); !hasEvent(events, a, poller.Out) {
+		t.Fatalf("WaitContext() = %v, want Out event of %d", events, a)
+	}
+	if err := e.Mod(a, poller.Readable); err != nil {
+		t.Fatalf("Mod(): %v", err)
+	}
+	if events := waitEvents(t, e, 50*time.Millisecond); len(events) != 0 {
+		t.Errorf("WaitContext() after Mod() = %v, want no events", events)
+	}
+}
+
+func TestHangUp(t *testing.T) {
+	e := newEpoll(t, LevelTriggered)
+	a, b := socketPair(t)
+	if err := e.Add(a, poller.Readable); err != nil {
+		t.Fatalf("Add(): %v", err)
+	}
+	if err := unix.Shutdown(b, unix.SHUT_WR); err != nil {
+		t.Fatalf("Shutdown(): %v", err)
+	}
+	if events := waitEvents(t, e, time.Second); !hasEvent(events, a, poller.RdHup) {
+		t.Errorf("WaitContext() = %v, want RdHup event of %d", events, a)
+	}
+}
+
+func TestWake(t *testing.T) {
+	e := newEpoll(t, LevelTriggered)
+
+	// Wake before WaitContext interrupts the next one
+	if err := e.Wake(); err != nil {
+		t.Fatalf("Wake(): %v", err)
+	}
+	events, err := e.WaitContext(context.Background())
+	if err != nil || len(events) != 0 {
+		t.Fatalf("WaitContext() = %v, %v, want no events", events, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := e.WaitContext(context.Background())
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := e.Wake(); err != nil {
+		t.Fatalf("Wake(): %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("WaitContext() interrupted by Wake() = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wake() didn't interrupt WaitContext()")
+	}
+}
+
+func TestWaitContextDone(t *testing.T) {
+	e := newEpoll(t, LevelTriggered)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := e.WaitContext(ctx); err != context.Canceled {
+		t.Errorf("WaitContext() = %v, want %v", err, context.Canceled)
+	}
+	if _, err := e.WaitContext(ctx); err != context.Canceled {
+		t.Errorf("WaitContext() with done ctx = %v, want %v", err, context.Canceled)
+	}
+
+	e.Close()
+	if err := e.Wake(); err == nil {
+		t.Error("Wake() of closed epoll didn't fail")
+	}
+}
@@ -0,0 +1,12 @@
+package epoll
+
+// Mode defines how file descriptors are registered in Epoll.
+type Mode int
+
+const (
+	// LevelTriggered reports events while the associated fd stays ready.
+	LevelTriggered Mode = iota
+	// EdgeTriggered reports events only when the associated fd changes its state.
+	// The reader has to drain fd until EAGAIN, otherwise the next event may never come.
+	EdgeTriggered
+)
@@ -0,0 +1,63 @@
+package poller
+
+import (
+	"context"
+)
+
+// Poller notifies about readiness of registered file descriptors.
+type Poller interface {
+	// Add registers fd with the Interest.
+	Add(fd int, interest Interest) error
+	// Mod changes the Interest of the registered fd.
+	Mod(fd int, interest Interest) error
+	// Rearm enables the fd registered with OneShot again, so the next event of the Interest is reported.
+	Rearm(fd int, interest Interest) error
+	// Del deregisters fd.
+	Del(fd int) error
+	// Wake interrupts the current or the next WaitContext.
+	Wake() error
+	// WaitContext blocks until registered fds have events, Wake is called or ctx is done.
+	// It returns no events if it was interrupted by Wake, and ctx error if ctx is done.
+	WaitContext(ctx context.Context) ([]Event, error)
+	// Close releases Poller resources.
+	Close() error
+}
+
+// Interest defines which fd readiness events are reported by Poller.
+// Hang up and error events are always reported, except for the disabled OneShot fd.
+type Interest uint8
+
+const (
+	// Readable reports that fd has data to read or its peer shut down writing half of connection.
+	Readable Interest = 1 << iota
+	// Writable reports that fd can accept data for writing.
+	Writable
+	// OneShot disables fd after its first event. No events of fd are reported until Rearm.
+	// So the event handler owns fd exclusively until it calls Rearm.
+	OneShot
+	// Exclusive reports the event of fd registered in several pollers to one of them (or some of them) only.
+	// It can be used only with Add and can't be combined with OneShot. Pollers without such feature ignore it.
+	Exclusive
+)
+
+// Flags describes the readiness of fd.
+type Flags uint8
+
+const (
+	// In - fd has data to read.
+	In Flags = 1 << iota
+	// Out - fd can accept data for writing.
+	Out
+	// RdHup - stream socket peer closed connection, or shut down writing half of connection.
+	RdHup
+	// Hup - hang up happened on fd.
+	Hup
+	// Err - error condition happened on fd.
+	Err
+)
+
+// Event is the readiness event of the registered fd.
+type Event struct {
+	Fd    int
+	Flags Flags
+}
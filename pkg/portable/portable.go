@@ -0,0 +1,338 @@
+//go:build unix
+
+package portable
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hotafrika/tcp_proxy_epoll/pkg/poller"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Poller is the goroutine-per-connection implementation of poller.Poller.
+// Every registered fd is duplicated and wrapped in os.File, so its readiness is awaited by goroutines with Go runtime netpoller.
+// It works in every unix system, and it is the reference implementation for benchmarks.
+// Registered fds have to be non-blocking, because Go runtime netpoller doesn't wait for blocking ones.
+// Like level-triggered epoll, it reports fd again and again while fd stays ready.
+// Like EPOLLONESHOT, the fd registered with OneShot is disabled after its first event until Rearm.
+// Exclusive interest is ignored.
+// Like epoll, it doesn't report events of fd after Del, except for WaitContext running at the same time.
+type Poller struct {
+	mu       sync.Mutex
+	watchers map[int]*watcher
+	events   chan watcherEvent
+	wake     chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var _ poller.Poller = (*Poller)(nil)
+
+// watcherEvent is the event sent by the watcher. It is dropped if the watcher is closed before WaitContext takes it.
+type watcherEvent struct {
+	w     *watcher
+	event poller.Event
+}
+
+// watcher waits for readiness of one fd. It has one goroutine for every Interest.
+type watcher struct {
+	fd   int
+	file *os.File
+	rc   syscall.RawConn
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	interest poller.Interest
+	// disabled is set after the event of OneShot fd.
+	disabled bool
+	closed   bool
+}
+
+var (
+	errClosed = errors.New("poller is closed")
+)
+
+var (
+	// aLongTimeAgo is the deadline which interrupts the waiting goroutine immediately.
+	aLongTimeAgo = time.Unix(1, 0)
+	noDeadline   = time.Time{}
+)
+
+func New() *Poller {
+	return &Poller{
+		watchers: make(map[int]*watcher),
+		events:   make(chan watcherEvent, 128),
+		wake:     make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Add registers fd with the Interest.
+func (p *Poller) Add(fd int, interest poller.Interest) error {
+	dupFd, err := unix.Dup(fd)
+	if err != nil {
+		return errors.Wrap(err, "Dup()")
+	}
+	unix.CloseOnExec(dupFd)
+	file := os.NewFile(uintptr(dupFd), "")
+	rc, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "SyscallConn()")
+	}
+	w := &watcher{
+		fd:       fd,
+		file:     file,
+		rc:       rc,
+		interest: interest,
+	}
+	w.cond = sync.NewCond(&w.mu)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.closed:
+		file.Close()
+		return errClosed
+	default:
+	}
+	if _, ok := p.watchers[fd]; ok {
+		file.Close()
+		return errors.Wrap(unix.EEXIST, "Add()")
+	}
+	p.watchers[fd] = w
+
+	go p.watch(w, poller.Readable)
+	go p.watch(w, poller.Writable)
+	return nil
+}
+
+// Mod changes the Interest of the registered fd.
+func (p *Poller) Mod(fd int, interest poller.Interest) error {
+	w := p.watcher(fd)
+	if w == nil {
+		return errors.Wrap(unix.ENOENT, "Mod()")
+	}
+	w.setInterest(interest)
+	return nil
+}
+
+// Rearm enables the disabled OneShot fd again with the Interest.
+func (p *Poller) Rearm(fd int, interest poller.Interest) error {
+	return p.Mod(fd, interest|poller.OneShot)
+}
+
+// Del deregisters fd and stops its goroutines.
+func (p *Poller) Del(fd int) error {
+	p.mu.Lock()
+	w, ok := p.watchers[fd]
+	delete(p.watchers, fd)
+	p.mu.Unlock()
+	if !ok {
+		return errors.Wrap(unix.ENOENT, "Del()")
+	}
+	w.close()
+	return nil
+}
+
+// Wake interrupts the current or the next WaitContext.
+func (p *Poller) Wake() error {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// WaitContext returns events of registered fds. It blocks until new events, Wake or ctx is done.
+func (p *Poller) WaitContext(ctx context.Context) ([]poller.Event, error) {
+	var events []poller.Event
+	// events of deleted fds are dropped, so it waits until it has others
+	for len(events) == 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-p.closed:
+			return nil, errClosed
+		case <-p.wake:
+			return nil, nil
+		case we := <-p.events:
+			events = we.appendTo(events)
+		}
+	}
+	for len(events) < cap(p.events) {
+		select {
+		case we := <-p.events:
+			events = we.appendTo(events)
+		default:
+			return events, nil
+		}
+	}
+	return events, nil
+}
+
+// appendTo appends the event to events unless fd was deleted after the event had been sent.
+func (we watcherEvent) appendTo(events []poller.Event) []poller.Event {
+	we.w.mu.Lock()
+	defer we.w.mu.Unlock()
+	if we.w.closed {
+		return events
+	}
+	return append(events, we.event)
+}
+
+// Close deregisters all fds.
+func (p *Poller) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	p.mu.Lock()
+	watchers := p.watchers
+	p.watchers = make(map[int]*watcher)
+	p.mu.Unlock()
+	for _, w := range watchers {
+		w.close()
+	}
+	return nil
+}
+
+func (p *Poller) watcher(fd int) *watcher {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.watchers[fd]
+}
+
+// watch is a blocking function. It waits for fd readiness of the interest and sends events until watcher is closed.
+func (p *Poller) watch(w *watcher, interest poller.Interest) {
+	for w.await(interest) {
+		flags, err := w.wait(interest)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// interest was removed by Mod
+			continue
+		}
+		if err != nil {
+			// the file was closed by Del
+			return
+		}
+		if !w.take() {
+			// the OneShot fd was disabled by the event of another interest
+			continue
+		}
+		select {
+		case p.events <- watcherEvent{w: w, event: poller.Event{Fd: w.fd, Flags: flags}}:
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+// await blocks until the watcher has the interest and it is enabled. It returns false if the watcher is closed.
+func (w *watcher) await(interest poller.Interest) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for !w.closed && (w.interest&interest == 0 || w.disabled) {
+		w.cond.Wait()
+	}
+	return !w.closed
+}
+
+// take checks if the event can be reported. The OneShot fd is disabled by its first event.
+func (w *watcher) take() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.interest&poller.OneShot == 0 {
+		return true
+	}
+	if w.disabled {
+		return false
+	}
+	w.disabled = true
+	return true
+}
+
+// wait blocks until fd is ready for the interest.
+// The readiness is checked with poll(2) before waiting, because Go runtime netpoller reports only new readiness.
+func (w *watcher) wait(interest poller.Interest) (poller.Flags, error) {
+	var revents int16
+	ready := func(fd uintptr) bool {
+		events := int16(unix.POLLIN)
+		if interest == poller.Writable {
+			events = unix.POLLOUT
+		}
+		fds := []unix.PollFd{{Fd: int32(fd), Events: events}}
+		n, err := unix.Poll(fds, 0)
+		if err != nil || n == 0 {
+			return false
+		}
+		revents = fds[0].Revents
+		return true
+	}
+
+	var err error
+	if interest == poller.Writable {
+		err = w.rc.Write(ready)
+	} else {
+		err = w.rc.Read(ready)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return flags(revents), nil
+}
+
+// setInterest changes the interest and interrupts goroutines waiting for removed interest.
+func (w *watcher) setInterest(interest poller.Interest) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	removed := w.interest &^ interest
+	w.interest = interest
+	// like EPOLL_CTL_MOD, changing of the interest enables the disabled fd
+	w.disabled = false
+	if removed&poller.Readable != 0 {
+		_ = w.file.SetReadDeadline(aLongTimeAgo)
+	} else if interest&poller.Readable != 0 {
+		_ = w.file.SetReadDeadline(noDeadline)
+	}
+	if removed&poller.Writable != 0 {
+		_ = w.file.SetWriteDeadline(aLongTimeAgo)
+	} else if interest&poller.Writable != 0 {
+		_ = w.file.SetWriteDeadline(noDeadline)
+	}
+	w.cond.Broadcast()
+}
+
+// close closes duplicated fd and stops watcher goroutines.
+func (w *watcher) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.file.Close()
+	w.cond.Broadcast()
+}
+
+// flags converts poll(2) revents to poller.Flags.
+func flags(revents int16) poller.Flags {
+	var f poller.Flags
+	if revents&unix.POLLIN != 0 {
+		f |= poller.In
+	}
+	if revents&unix.POLLOUT != 0 {
+		f |= poller.Out
+	}
+	if revents&unix.POLLHUP != 0 {
+		f |= poller.Hup
+	}
+	if revents&unix.POLLERR != 0 {
+		f |= poller.Err
+	}
+	return f
+}
@@ -0,0 +1,239 @@
+//go:build unix
+
+package portable
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hotafrika/tcp_proxy_epoll/pkg/poller"
+	"golang.org/x/sys/unix"
+)
+
+// socketPair returns connected non-blocking unix stream sockets, which are closed after the test.
+// Like connections of the proxy, they have to be non-blocking to be awaited with Go runtime netpoller.
+func socketPair(t *testing.T) (int, int) {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("Socketpair(): %v", err)
+	}
+	t.Cleanup(func() {
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+	})
+	for _, fd := range fds {
+		if err := unix.SetNonblock(fd, true); err != nil {
+			t.Fatalf("SetNonblock(): %v", err)
+		}
+	}
+	return fds[0], fds[1]
+}
+
+// waitEvents returns events of WaitContext, or nil if there are no events before timeout.
+func waitEvents(t *testing.T, p *Poller, timeout time.Duration) []poller.Event {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	events, err := p.WaitContext(ctx)
+	if err != nil && ctx.Err() == nil {
+		t.Fatalf("WaitContext(): %v", err)
+	}
+	return events
+}
+
+func TestNoEventsAfterDel(t *testing.T) {
+	p := New()
+	defer p.Close()
+	a, b := socketPair(t)
+	if err := p.Add(a, poller.Readable); err != nil {
+		t.Fatalf("Add(): %v", err)
+	}
+	if _, err := unix.Write(b, []byte("x")); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	// level-triggered fd is reported again and again, so events are queued
+	time.Sleep(50 * time.Millisecond)
+	if err := p.Del(a); err != nil {
+		t.Fatalf("Del(): %v", err)
+	}
+	if events := waitEvents(t, p, 100*time.Millisecond); len(events) != 0 {
+		t.Errorf("WaitContext() after Del() = %v, want no events", events)
+	}
+}
+
+// writeByte makes fd readable.
+func writeByte(t *testing.T, fd int) {
+	t.Helper()
+	if _, err := unix.Write(fd, []byte("x")); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+}
+
+// hasEvent reports if events have the event of fd with flags.
+func hasEvent(events []poller.Event, fd int, flags poller.Flags) bool {
+	for _, event := range events {
+		if event.Fd == fd && event.Flags&flags == flags {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAdd(t *testing.T) {
+	p := New()
+	defer p.Close()
+	a, b := socketPair(t)
+	if err := p.Add(a, poller.Readable); err != nil {
+		t.Fatalf("Add(): %v", err)
+	}
+	if err := p.Add(a, poller.Readable); err == nil {
+		t.Error("Add() of the registered fd didn't fail")
+	}
+	if events := waitEvents(t, p, 100*time.Millisecond); len(events) != 0 {
+		t.Errorf("WaitContext() = %v, want no events", events)
+	}
+	writeByte(t, b)
+	if events := waitEvents(t, p, time.Second); !hasEvent(events, a, poller.In) {
+		t.Errorf("WaitContext() = %v, want In event of %d", events, a)
+	}
+}
+
+func TestLevelTriggered(t *testing.T) {
+	p := New()
+	defer p.Close()
+	a, b := socketPair(t)
+	if err := p.Add(a, poller.Readable); err != nil {
+		t.Fatalf("Add(): %v", err)
+	}
+	writeByte(t, b)
+	// the data isn't read, so fd is reported again
+	for i := 0; i < 2; i++ {
+		if events := waitEvents(t, p, time.Second); !hasEvent(events, a, poller.In) {
+			t.Fatalf("WaitContext() %d = %v, want In event of %d", i, events, a)
+		}
+	}
+}
+
+func TestOneShotRearm(t *testing.T) {
+	p := New()
+	defer p.Close()
+	a, b := socketPair(t)
+	if err := p.Add(a, poller.Readable|poller.OneShot); err != nil {
+		t.Fatalf("Add(): %v", err)
+	}
+	writeByte(t, b)
+	if events := waitEvents(t, p, time.Second); !hasEvent(events, a, poller.In) {
+		t.Fatalf("WaitContext() = %v, want In event of %d", events, a)
+	}
+	// fd is still readable, but it is disabled until Rearm
+	if events := waitEvents(t, p, 100*time.Millisecond); len(events) != 0 {
+		t.Fatalf("WaitContext() of disabled fd = %v, want no events", events)
+	}
+	if err := p.Rearm(a, poller.Readable); err != nil {
+		t.Fatalf("Rearm(): %v", err)
+	}
+	if events := waitEvents(t, p, time.Second); !hasEvent(events, a, poller.In) {
+		t.Fatalf("WaitContext() after Rearm() = %v, want In event of %d", events, a)
+	}
+	if events := waitEvents(t, p, 100*time.Millisecond); len(events) != 0 {
+		t.Errorf("WaitContext() of disabled fd = %v, want no events", events)
+	}
+}
+
+func TestMod(t *testing.T) {
+	p := New()
+	defer p.Close()
+	a, _ := socketPair(t)
+	if err := p.Mod(a, poller.Readable); err == nil {
+		t.Error("Mod() of unknown fd didn't fail")
+	}
+	if err := p.Add(a, poller.Readable); err != nil {
+		t.Fatalf("Add(): %v", err)
+	}
+	if events := waitEvents(t, p, 100*time.Millisecond); len(events) != 0 {
+		t.Fatalf("WaitContext() = %v, want no events", events)
+	}
+	// the socket buffer is empty, so fd is writable
+	if err := p.Mod(a, poller.Writable); err != nil {
+		t.Fatalf("Mod(): %v", err)
+	}
+	if events := waitEvents(t, p, time.Second); !hasEvent(events, a, poller.Out) {
+		t.Fatalf("WaitContext() = %v, want Out event of %d", events, a)
+	}
+	if err := p.Mod(a, poller.Readable); err != nil {
+		t.Fatalf("Mod(): %v", err)
+	}
+	// Out events sent before Mod may be still queued
+	waitEvents(t, p, 50*time.Millisecond)
+	if events := waitEvents(t, p, 100*time.Millisecond); len(events) != 0 {
+		t.Errorf("WaitContext() after Mod() = %v, want no events", events)
+	}
+}
+
+func TestDel(t *testing.T) {
+	p := New()
+	defer p.Close()
+	a, _ := socketPair(t)
+	if err := p.Del(a); err == nil {
+		t.Error("Del() of unknown fd didn't fail")
+	}
+	if err := p.Add(a, poller.Readable); err != nil {
+		t.Fatalf("Add(): %v", err)
+	}
+	if err := p.Del(a); err != nil {
+		t.Fatalf("Del(): %v", err)
+	}
+	// fd can be added again after Del
+	if err := p.Add(a, poller.Readable); err != nil {
+		t.Fatalf("Add() after Del(): %v", err)
+	}
+}
+
+func TestWake(t *testing.T) {
+	p := New()
+	defer p.Close()
+
+	// Wake before WaitContext interrupts the next one
+	if err := p.Wake(); err != nil {
+		t.Fatalf("Wake(): %v", err)
+	}
+	events, err := p.WaitContext(context.Background())
+	if err != nil || len(events) != 0 {
+		t.Fatalf("WaitContext() = %v, %v, want no events", events, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.WaitContext(context.Background())
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := p.Wake(); err != nil {
+		t.Fatalf("Wake(): %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("WaitContext() interrupted by Wake() = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wake() didn't interrupt WaitContext()")
+	}
+}
+
+func TestWaitContextDone(t *testing.T) {
+	p := New()
+	defer p.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := p.WaitContext(ctx); err != context.Canceled {
+		t.Errorf("WaitContext() = %v, want %v", err, context.Canceled)
+	}
+
+	p.Close()
+	if _, err := p.WaitContext(context.Background()); err == nil {
+		t.Error("WaitContext() of closed poller didn't fail")
+	}
+}
@@ -0,0 +1,91 @@
+//go:build linux
+
+package uring
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	opWriteFixed  = 5
+	opAccept      = 13
+	opAsyncCancel = 14
+	opRead        = 22
+	opRecv        = 27
+)
+
+const (
+	sqeBufferSelect = 1 << 5
+
+	acceptMultishot = 1 << 0
+	recvMultishot   = 1 << 1
+)
+
+const (
+	// CQEFBuffer means that the upper 16 bits of CQE flags are the provided buffer id.
+	CQEFBuffer = 1 << 0
+	// CQEFMore means that the multishot request will post more CQEs.
+	CQEFMore = 1 << 1
+
+	cqeBufferShift = 16
+)
+
+// BufferID returns the provided buffer id of the completed request.
+func (c *CQE) BufferID() uint16 {
+	return uint16(c.Flags >> cqeBufferShift)
+}
+
+// More returns true if the multishot request is still active.
+func (c *CQE) More() bool {
+	return c.Flags&CQEFMore != 0
+}
+
+// PrepMultishotAccept prepares the request which accepts connections of the listener fd until it is canceled.
+// Accepted fds are non-blocking and close-on-exec.
+func (s *SQE) PrepMultishotAccept(fd int, userData uint64) {
+	s.Opcode = opAccept
+	s.Fd = int32(fd)
+	s.IoPrio = acceptMultishot
+	s.OpFlags = unix.SOCK_NONBLOCK | unix.SOCK_CLOEXEC
+	s.UserData = userData
+}
+
+// PrepMultishotRecv prepares the request which receives data of fd into buffers of the group until it is canceled.
+func (s *SQE) PrepMultishotRecv(fd int, group uint16, userData uint64) {
+	s.Opcode = opRecv
+	s.Fd = int32(fd)
+	s.IoPrio = recvMultishot
+	s.Flags = sqeBufferSelect
+	s.BufIndex = group
+	s.UserData = userData
+}
+
+// PrepWriteFixed prepares the request which writes data from the fixed buffer to fd.
+func (s *SQE) PrepWriteFixed(fd int, data []byte, bufIndex uint16, userData uint64) {
+	s.Opcode = opWriteFixed
+	s.Fd = int32(fd)
+	s.Addr = uint64(uintptr(unsafe.Pointer(&data[0])))
+	s.Len = uint32(len(data))
+	s.BufIndex = bufIndex
+	s.UserData = userData
+}
+
+// PrepRead prepares the request which reads data of fd into buf.
+// buf must not be moved or freed until the request is completed.
+func (s *SQE) PrepRead(fd int, buf []byte, userData uint64) {
+	s.Opcode = opRead
+	s.Fd = int32(fd)
+	s.Addr = uint64(uintptr(unsafe.Pointer(&buf[0])))
+	s.Len = uint32(len(buf))
+	s.UserData = userData
+}
+
+// PrepCancel prepares the request which cancels the request with target user data.
+func (s *SQE) PrepCancel(target uint64, userData uint64) {
+	s.Opcode = opAsyncCancel
+	s.Fd = -1
+	s.Addr = target
+	s.UserData = userData
+}
@@ -0,0 +1,44 @@
+//go:build linux
+
+package uring
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Probe checks if the kernel supports io_uring features used by the proxy:
+// provided buffers ring, multishot accept and multishot recv (linux 6.0+).
+func Probe() error {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return errors.Wrap(err, "Uname()")
+	}
+	release := unix.ByteSliceToString(uts.Release[:])
+	if kernelMajor(release) < 6 {
+		return errors.Errorf("kernel %s doesn't support multishot recv", release)
+	}
+
+	r, err := New(2, 4)
+	if err != nil {
+		return err
+	}
+	bufRing, err := r.RegisterBufRing(2, 0)
+	// the buf ring memory is freed only after io_uring is closed, so the kernel doesn't use it anymore
+	closeErr := r.Close()
+	if err != nil {
+		return err
+	}
+	bufRing.Free()
+	return closeErr
+}
+
+// kernelMajor parses the major version of the kernel release string.
+func kernelMajor(release string) int {
+	major, _, _ := strings.Cut(release, ".")
+	n, _ := strconv.Atoi(major)
+	return n
+}
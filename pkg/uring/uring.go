@@ -0,0 +1,12 @@
+//go:build !linux
+
+package uring
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Probe reports that io_uring is not available. It works only in Linux systems.
+func Probe() error {
+	return errors.New("it works only in Linux systems")
+}
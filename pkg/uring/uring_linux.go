@@ -0,0 +1,331 @@
+//go:build linux
+
+package uring
+
+import (
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Ring is a minimal io_uring wrapper. It is not safe for concurrent use:
+// submissions and completions have to be handled by one goroutine.
+type Ring struct {
+	fd     int
+	params params
+
+	sqRing []byte
+	cqRing []byte
+	sqes   []byte
+
+	sqHead    *uint32
+	sqTail    *uint32
+	sqMask    uint32
+	sqEntries uint32
+	sqArray   []uint32
+	// sqLocal is the tail of filled, but not yet published SQEs.
+	sqLocal uint32
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   []CQE
+}
+
+// SQE is the io_uring submission queue entry.
+type SQE struct {
+	Opcode      uint8
+	Flags       uint8
+	IoPrio      uint16
+	Fd          int32
+	Off         uint64
+	Addr        uint64
+	Len         uint32
+	OpFlags     uint32
+	UserData    uint64
+	BufIndex    uint16
+	Personality uint16
+	SpliceFdIn  int32
+	Addr3       uint64
+	_           uint64
+}
+
+// CQE is the io_uring completion queue entry.
+type CQE struct {
+	UserData uint64
+	Res      int32
+	Flags    uint32
+}
+
+type sqRingOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	flags       uint32
+	dropped     uint32
+	array       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type cqRingOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	overflow    uint32
+	cqes        uint32
+	flags       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type params struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        sqRingOffsets
+	cqOff        cqRingOffsets
+}
+
+const (
+	setupCQSize = 1 << 3
+
+	featSingleMmap = 1 << 0
+
+	offSQRing = 0
+	offCQRing = 0x8000000
+	offSQEs   = 0x10000000
+
+	enterGetEvents = 1 << 0
+
+	registerBuffers  = 0
+	registerPbufRing = 22
+)
+
+// New creates io_uring with sqEntries submission queue entries and cqEntries completion queue entries.
+func New(sqEntries, cqEntries uint32) (*Ring, error) {
+	r := &Ring{}
+	r.params.flags = setupCQSize
+	r.params.cqEntries = cqEntries
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(sqEntries), uintptr(unsafe.Pointer(&r.params)), 0)
+	if errno != 0 {
+		return nil, errors.Wrap(errno, "io_uring_setup()")
+	}
+	r.fd = int(fd)
+
+	if err := r.mmap(); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// mmap maps submission and completion queues.
+func (r *Ring) mmap() error {
+	p := &r.params
+	sqSize := int(p.sqOff.array + p.sqEntries*4)
+	cqSize := int(p.cqOff.cqes + p.cqEntries*uint32(unsafe.Sizeof(CQE{})))
+	if p.features&featSingleMmap != 0 && cqSize > sqSize {
+		sqSize = cqSize
+	}
+
+	var err error
+	r.sqRing, err = unix.Mmap(r.fd, offSQRing, sqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return errors.Wrap(err, "Mmap() sq ring")
+	}
+	r.cqRing = r.sqRing
+	if p.features&featSingleMmap == 0 {
+		r.cqRing, err = unix.Mmap(r.fd, offCQRing, cqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+		if err != nil {
+			return errors.Wrap(err, "Mmap() cq ring")
+		}
+	}
+	r.sqes, err = unix.Mmap(r.fd, offSQEs, int(p.sqEntries)*int(unsafe.Sizeof(SQE{})), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return errors.Wrap(err, "Mmap() sqes")
+	}
+
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqEntries = *(*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringEntries]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array])), p.sqEntries)
+	r.sqLocal = atomic.LoadUint32(r.sqTail)
+
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*CQE)(unsafe.Pointer(&r.cqRing[p.cqOff.cqes])), p.cqEntries)
+	return nil
+}
+
+// Close unmaps queues and closes io_uring fd. The kernel cancels all in-flight requests.
+func (r *Ring) Close() error {
+	if r.sqes != nil {
+		_ = unix.Munmap(r.sqes)
+	}
+	if r.cqRing != nil && &r.cqRing[0] != &r.sqRing[0] {
+		_ = unix.Munmap(r.cqRing)
+	}
+	if r.sqRing != nil {
+		_ = unix.Munmap(r.sqRing)
+	}
+	err := unix.Close(r.fd)
+	if err != nil {
+		return errors.Wrap(err, "Close()")
+	}
+	return nil
+}
+
+// SQE returns the next free submission queue entry. It submits filled entries if the queue is full.
+func (r *Ring) SQE() (*SQE, error) {
+	for r.sqLocal-atomic.LoadUint32(r.sqHead) >= r.sqEntries {
+		if _, err := r.Submit(0); err != nil {
+			return nil, err
+		}
+	}
+	idx := r.sqLocal & r.sqMask
+	sqe := (*SQE)(unsafe.Pointer(&r.sqes[uintptr(idx)*unsafe.Sizeof(SQE{})]))
+	*sqe = SQE{}
+	r.sqArray[idx] = idx
+	r.sqLocal++
+	return sqe, nil
+}
+
+// Submit publishes filled entries to the kernel and waits for minComplete completions.
+func (r *Ring) Submit(minComplete uint32) (int, error) {
+	toSubmit := r.sqLocal - atomic.LoadUint32(r.sqTail)
+	atomic.StoreUint32(r.sqTail, r.sqLocal)
+
+	var flags uintptr
+	if minComplete > 0 {
+		flags = enterGetEvents
+	}
+	for {
+		n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete), flags, 0, 0)
+		if errno == unix.EINTR {
+			// submitted entries are consumed by the kernel even if waiting was interrupted
+			toSubmit = 0
+			continue
+		}
+		if errno != 0 {
+			return int(n), errors.Wrap(errno, "io_uring_enter()")
+		}
+		return int(n), nil
+	}
+}
+
+// PeekCQE returns the next completion queue entry or nil. The entry has to be released with SeenCQE.
+func (r *Ring) PeekCQE() *CQE {
+	head := atomic.LoadUint32(r.cqHead)
+	if head == atomic.LoadUint32(r.cqTail) {
+		return nil
+	}
+	return &r.cqes[head&r.cqMask]
+}
+
+// SeenCQE releases the entry returned by PeekCQE.
+func (r *Ring) SeenCQE() {
+	atomic.AddUint32(r.cqHead, 1)
+}
+
+// RegisterBuffer registers buf as the fixed buffer with index 0.
+func (r *Ring) RegisterBuffer(buf []byte) error {
+	iov := unix.Iovec{Base: &buf[0]}
+	iov.SetLen(len(buf))
+	_, _, errno := unix.Syscall6(unix.SYS_IO_URING_REGISTER, uintptr(r.fd), registerBuffers, uintptr(unsafe.Pointer(&iov)), 1, 0, 0)
+	if errno != 0 {
+		return errors.Wrap(errno, "io_uring_register() buffers")
+	}
+	return nil
+}
+
+// buf is the entry of the provided buffers ring.
+type buf struct {
+	addr uint64
+	len  uint32
+	bid  uint16
+	// resv of the first entry is the ring tail
+	resv uint16
+}
+
+// BufRing is the ring of provided buffers. The kernel selects buffers from it for requests with BufferSelect flag.
+type BufRing struct {
+	mem     []byte
+	bufs    []buf
+	tail    *uint16
+	mask    uint16
+	pending uint16
+}
+
+type bufReg struct {
+	ringAddr    uint64
+	ringEntries uint32
+	bgid        uint16
+	flags       uint16
+	resv        [3]uint64
+}
+
+// RegisterBufRing registers the ring of provided buffers with entries (power of 2) and group id.
+func (r *Ring) RegisterBufRing(entries uint16, group uint16) (*BufRing, error) {
+	size := int(entries) * int(unsafe.Sizeof(buf{}))
+	mem, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANONYMOUS|unix.MAP_PRIVATE|unix.MAP_POPULATE)
+	if err != nil {
+		return nil, errors.Wrap(err, "Mmap() buf ring")
+	}
+	reg := bufReg{
+		ringAddr:    uint64(uintptr(unsafe.Pointer(&mem[0]))),
+		ringEntries: uint32(entries),
+		bgid:        group,
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_IO_URING_REGISTER, uintptr(r.fd), registerPbufRing, uintptr(unsafe.Pointer(&reg)), 1, 0, 0)
+	if errno != 0 {
+		_ = unix.Munmap(mem)
+		return nil, errors.Wrap(errno, "io_uring_register() buf ring")
+	}
+	bufs := unsafe.Slice((*buf)(unsafe.Pointer(&mem[0])), entries)
+	return &BufRing{
+		mem:  mem,
+		bufs: bufs,
+		tail: &bufs[0].resv,
+		mask: entries - 1,
+	}, nil
+}
+
+// Add adds the buffer with bid to the ring. Added buffers become available for the kernel after Advance.
+func (b *BufRing) Add(addr unsafe.Pointer, length uint32, bid uint16) {
+	idx := (*b.tail + b.pending) & b.mask
+	e := &b.bufs[idx]
+	e.addr = uint64(uintptr(addr))
+	e.len = length
+	e.bid = bid
+	b.pending++
+}
+
+// Advance publishes added buffers to the kernel.
+func (b *BufRing) Advance() {
+	if b.pending == 0 {
+		return
+	}
+	// the tail is uint16, so it is published with 32-bit atomic store of the word with bid and tail of the first entry
+	word := atomic.LoadUint32((*uint32)(unsafe.Pointer(&b.bufs[0].bid)))
+	halves := (*[2]uint16)(unsafe.Pointer(&word))
+	halves[1] = *b.tail + b.pending
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&b.bufs[0].bid)), word)
+	b.pending = 0
+}
+
+// Free unmaps the ring memory. The ring has to be unregistered or io_uring has to be closed before.
+func (b *BufRing) Free() {
+	_ = unix.Munmap(b.mem)
+}
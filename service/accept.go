@@ -0,0 +1,26 @@
+//go:build !linux
+
+package service
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// accept accepts new non-blocking connection of the listening socket.
+// accept4(2) isn't available, so flags are set after accept(2) under syscall.ForkLock.
+func accept(fd int) (int, error) {
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	nfd, _, err := unix.Accept(fd)
+	if err != nil {
+		return -1, err
+	}
+	unix.CloseOnExec(nfd)
+	if err := unix.SetNonblock(nfd, true); err != nil {
+		unix.Close(nfd)
+		return -1, err
+	}
+	return nfd, nil
+}
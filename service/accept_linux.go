@@ -0,0 +1,13 @@
+//go:build linux
+
+package service
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// accept accepts new non-blocking connection of the listening socket.
+func accept(fd int) (int, error) {
+	nfd, _, err := unix.Accept4(fd, unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+	return nfd, err
+}
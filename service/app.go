@@ -2,6 +2,9 @@ package service
 
 import (
 	"context"
+	"net"
+	"sort"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
@@ -11,52 +14,163 @@ type application struct {
 	logger *zerolog.Logger
 	name   string
 	bnds   []*backend
+	// tiers are backends grouped by priority, from the lowest (preferred) priority.
+	tiers [][]*backend
+	// minHealthy is the min number of available backends, which are chosen from the preferred tiers.
+	// When preferred tiers have fewer available backends, the next tier gets traffic too.
+	minHealthy int
+	// balancer chooses the next backend among active ones.
+	balancer balancer
+	// sticky is set if clients stick to their backends.
+	sticky *stickyTable
+	// retry defines attempts of connecting the client to backends.
+	retry retryPolicy
+	// queue is set if clients wait for available backends.
+	queue *clientQueue
+	// pipes is set if the app uses splice relay mode.
+	pipes *pipePool
 }
 
-func newApplication(ctx context.Context, logger *zerolog.Logger, name string, bnds []*backend) *application {
+func newApplication(ctx context.Context, logger *zerolog.Logger, name string, bnds []*backend, minHealthy int, balancer balancer, sticky *stickyTable, retry retryPolicy, queue *clientQueue, pipes *pipePool) *application {
+	if queue != nil {
+		for _, bnd := range bnds {
+			bnd.notify = queue.notify
+		}
+	}
 	return &application{
-		logger: logger,
-		name:   name,
-		bnds:   bnds,
+		logger:     logger,
+		name:       name,
+		bnds:       bnds,
+		tiers:      groupTiers(bnds),
+		minHealthy: minHealthy,
+		balancer:   balancer,
+		sticky:     sticky,
+		retry:      retry,
+		queue:      queue,
+		pipes:      pipes,
+	}
+}
+
+// groupTiers groups backends by priority. Tiers are sorted from the lowest priority, backends keep their order in tiers.
+func groupTiers(bnds []*backend) [][]*backend {
+	sorted := append([]*backend(nil), bnds...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].priority < sorted[j].priority
+	})
+	var tiers [][]*backend
+	for i, bnd := range sorted {
+		if i == 0 || bnd.priority != sorted[i-1].priority {
+			tiers = append(tiers, nil)
+		}
+		tiers[len(tiers)-1] = append(tiers[len(tiers)-1], bnd)
 	}
+	return tiers
 }
 
 var (
 	errNoActiveBackend = errors.New("no active backends")
+	errBackendsFull    = errors.New("all active backends are at max connections")
+	// errAllExcluded means that all backends are already tried by the client, so it can't wait for them in the queue.
+	errAllExcluded = errors.New("all backends are already tried")
 )
 
-// nextBackend chooses the next available backend with MIN number of connections.
-func (a *application) nextBackend() (*backend, error) {
-	var next *backend
-	var minConnCount int
-	for _, bnd := range a.bnds {
-		if bnd.active.Load() {
-			if next == nil {
-				next = bnd
-				minConnCount = bnd.getConnCount()
+// nextBackend chooses the next available backend for the client and reserves its connection slot. Backends from exclude are skipped.
+func (a *application) nextBackend(client net.Addr, exclude []*backend) (*backend, error) {
+	for {
+		available, err := a.availableBackends(exclude)
+		if err != nil {
+			return nil, err
+		}
+		bnd := a.chooseBackend(client, available)
+		// the backend can be filled up by concurrent connects after the check
+		if bnd.reserve() {
+			return bnd, nil
+		}
+	}
+}
+
+// availableBackends returns active backends which accept new connections. Backends from exclude are skipped.
+// Available backends are taken from tiers in priority order until there are at least minHealthy of them.
+func (a *application) availableBackends(exclude []*backend) ([]*backend, error) {
+	available := make([]*backend, 0, len(a.bnds))
+	full := false
+	// remaining is set if some backends are not excluded, so they may become available later
+	remaining := false
+	for _, tier := range a.tiers {
+		if len(available) >= a.minHealthy {
+			break
+		}
+		for _, bnd := range tier {
+			if bnd.weight == 0 || containsBackend(exclude, bnd) {
+				continue
+			}
+			remaining = true
+			if !bnd.active.Load() {
 				continue
 			}
-			if bnd.getConnCount() < minConnCount {
-				next = bnd
+			if bnd.full() {
+				full = true
+				continue
 			}
+			available = append(available, bnd)
 		}
 	}
-	if next == nil {
+	if len(available) == 0 {
+		if !remaining && len(exclude) > 0 {
+			return nil, errAllExcluded
+		}
+		if full {
+			return nil, errBackendsFull
+		}
 		return nil, errNoActiveBackend
 	}
-	return next, nil
+	return available, nil
+}
+
+// hasFreeSlot reports if some active backend accepts new connections, regardless of tiers and exclusions of clients.
+func (a *application) hasFreeSlot() bool {
+	for _, bnd := range a.bnds {
+		if bnd.active.Load() && bnd.weight > 0 && !bnd.full() {
+			return true
+		}
+	}
+	return false
 }
 
-// createRemoteConnection creates new outgoing connection Conn.
-func (a *application) createRemoteConnection() (*Conn, error) {
-	nextBackend, err := a.nextBackend()
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to get next backend")
+// chooseBackend chooses one of available backends for the client with the balancer of the app.
+// If the app has the sticky table, the client gets its previous backend while it is available.
+func (a *application) chooseBackend(client net.Addr, available []*backend) *backend {
+	if a.sticky == nil {
+		return a.balancer.next(available, client)
+	}
+
+	now := time.Now()
+	ip := clientIP(client)
+	if bnd := a.sticky.get(ip, now); bnd != nil && containsBackend(available, bnd) {
+		return bnd
 	}
-	rNetConn, err := nextBackend.createConn()
-	if err != nil {
-		// TODO add feature to find another next backend
-		return nil, errors.Wrap(err, "unable to connect to remote backend")
+	bnd := a.balancer.next(available, client)
+	a.sticky.set(ip, bnd, now)
+	return bnd
+}
+
+// connectRemote starts non-blocking connect to the next backend in the reactor. Failed connects are retried with other backends
+// according to the retry policy of the app. done is called once with the new outgoing connection Conn or the error, it must not block.
+func (a *application) connectRemote(r *reactor, client net.Addr, done func(*Conn, error)) {
+	newRemoteConnect(a, r, client, done).start()
+}
+
+// createRemoteConnection creates new outgoing connection Conn. It blocks until the connection is established,
+// so it is used only in io_uring mode, where connections aren't served by reactors.
+func (a *application) createRemoteConnection(client net.Addr) (*Conn, error) {
+	return newRemoteConnect(a, nil, client, nil).dial()
+}
+
+func containsBackend(bnds []*backend, bnd *backend) bool {
+	for _, b := range bnds {
+		if b == bnd {
+			return true
+		}
 	}
-	return newConn(rNetConn, nextBackend), nil
+	return false
 }
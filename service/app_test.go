@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+func TestNextBackend(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxConns []int
+		inactive []int
+		exclude  []int
+		want     int
+		wantErr  error
+		wantFree bool
+	}{
+		{name: "available", maxConns: []int{0, 0}, exclude: []int{0}, want: 1, wantFree: true},
+		{name: "full", maxConns: []int{1, 1}, wantErr: errBackendsFull},
+		{name: "inactive", maxConns: []int{0, 0}, inactive: []int{0, 1}, wantErr: errNoActiveBackend},
+		{name: "free slot is excluded", maxConns: []int{1, 2}, exclude: []int{1}, wantErr: errBackendsFull, wantFree: true},
+		{name: "inactive backend is not tried", maxConns: []int{0, 0}, inactive: []int{1}, exclude: []int{0}, wantErr: errNoActiveBackend, wantFree: true},
+		{name: "all tried", maxConns: []int{1, 2}, exclude: []int{0, 1}, wantErr: errAllExcluded, wantFree: true},
+		{name: "all tried and inactive", maxConns: []int{0, 0}, inactive: []int{0}, exclude: []int{0, 1}, wantErr: errAllExcluded, wantFree: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := zerolog.Nop()
+			bnds := newTestBackends(t, []int{1, 1}, nil)
+			for i, bnd := range bnds {
+				bnd.maxConns = tt.maxConns[i]
+				// backends with limits have one connection
+				if bnd.maxConns > 0 {
+					bnd.reserve()
+				}
+			}
+			for _, i := range tt.inactive {
+				bnds[i].active.Store(false)
+			}
+			var exclude []*backend
+			for _, i := range tt.exclude {
+				exclude = append(exclude, bnds[i])
+			}
+			blr, err := newBalancer("", "", bnds)
+			if err != nil {
+				t.Fatalf("newBalancer(): %v", err)
+			}
+			app := newApplication(context.Background(), &logger, "test", bnds, 1, blr, nil, retryPolicy{attempts: 1}, nil, nil)
+
+			bnd, err := app.nextBackend(nil, exclude)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("nextBackend() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && backendIndex(bnds, bnd) != tt.want {
+				t.Errorf("nextBackend() = %d, want %d", backendIndex(bnds, bnd), tt.want)
+			}
+			if got := app.hasFreeSlot(); got != tt.wantFree {
+				t.Errorf("hasFreeSlot() = %v, want %v", got, tt.wantFree)
+			}
+		})
+	}
+}
@@ -2,56 +2,95 @@ package service
 
 import (
 	"context"
-	"fmt"
 	"io"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/hotafrika/tcp_proxy_epoll/pkg/epoll"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
-	"golang.org/x/sys/unix"
 )
 
 type backend struct {
-	ctx         context.Context
-	logger      *zerolog.Logger
-	addr        string
-	dialler     net.Dialer
-	active      atomic.Bool
-	rmu         sync.RWMutex
-	connections map[int]*PipedConn
-	bufPool     *sync.Pool
-	epoller     *epoll.Epoll
+	ctx    context.Context
+	logger *zerolog.Logger
+	addr   string
+	// weight is the relative capacity of the backend. Backends with zero weight don't get new connections.
+	weight int
+	// priority is the tier of the backend. Backends with the lowest priority are preferred.
+	priority int
+	// maxConns limits connections of the backend, zero means no limit.
+	maxConns int
+	// slots is the number of connections of the backend, including connecting ones. It is limited by maxConns.
+	slots atomic.Int64
+	// notify is called when the backend may accept new connections: with all=true when it becomes active,
+	// and with all=false when one connection slot is freed.
+	notify func(all bool)
+	// latency is the peak EWMA of connect latency in nanoseconds. Failed connects are counted as connect timeouts.
+	latency ewma
+	// failures is the EWMA of the failed connects share.
+	failures ewma
+	// slowStart is the window after recovery, during which the effective weight rises from 10% to the full weight.
+	slowStart time.Duration
+	// recoveredAt is the unix time in nanoseconds when the backend became active after the first healthcheck.
+	recoveredAt atomic.Int64
+	// checked is set after the first healthcheck. The backend which is active from the start doesn't slow-start.
+	checked atomic.Bool
+	// raddr is the resolved address of the backend. It is refreshed by every healthcheck,
+	// so reactors connect to the backend without DNS lookups.
+	raddr atomic.Pointer[net.TCPAddr]
+	// connectTimeout is the timeout of connects for clients.
+	connectTimeout time.Duration
+	active         atomic.Bool
+	rmu            sync.RWMutex
+	connections    map[int]*PipedConn
+	bufPool        *sync.Pool
 
-	healthcheckInterval time.Duration
+	healthcheck healthcheck
+	// hmu protects counters of consecutive healthcheck results.
+	hmu       sync.Mutex
+	successes int
+	fails     int
+}
+
+// backendConfig is the config of the backend, which is merged from configs of the app and the target.
+type backendConfig struct {
+	weight         int
+	priority       int
+	maxConns       int
+	slowStart      time.Duration
+	connectTimeout time.Duration
+	healthcheck    healthcheck
 }
 
 var _ connManager = (*backend)(nil)
 
-func newBackend(ctx context.Context, logger *zerolog.Logger, address string, bufPool *sync.Pool) (*backend, error) {
+func newBackend(ctx context.Context, logger *zerolog.Logger, address string, config backendConfig, bufPool *sync.Pool) (*backend, error) {
 	_, _, err := net.SplitHostPort(address)
 	if err != nil {
 		return nil, errors.Wrap(err, "SplitHostPort()")
 	}
-	dialer := net.Dialer{
-		Timeout: 2 * time.Second,
+	if config.weight < 0 {
+		return nil, errors.Errorf("invalid weight %d of backend %q", config.weight, address)
 	}
-	epoller, err := epoll.New()
-	if err != nil {
-		return nil, errors.Wrap(err, "New()")
+	if config.maxConns < 0 {
+		return nil, errors.Errorf("invalid max connections %d of backend %q", config.maxConns, address)
 	}
 	return &backend{
-		ctx:                 ctx,
-		logger:              logger,
-		addr:                address,
-		dialler:             dialer,
-		connections:         make(map[int]*PipedConn),
-		bufPool:             bufPool,
-		epoller:             epoller,
-		healthcheckInterval: 5 * time.Second,
+		ctx:            ctx,
+		logger:         logger,
+		addr:           address,
+		weight:         config.weight,
+		priority:       config.priority,
+		maxConns:       config.maxConns,
+		latency:        ewma{peak: true},
+		notify:         func(bool) {},
+		slowStart:      config.slowStart,
+		connectTimeout: config.connectTimeout,
+		connections:    make(map[int]*PipedConn),
+		bufPool:        bufPool,
+		healthcheck:    config.healthcheck,
 	}, nil
 }
 
@@ -62,12 +101,9 @@ func (b *backend) addConn(conn *PipedConn) {
 		conn.Close()
 	default:
 	}
-	// add connection to the connection map
-	// add connection fd to epoll
 	b.rmu.Lock()
 	defer b.rmu.Unlock()
 	b.connections[conn.fd] = conn
-	b.epoller.Add(conn.fd)
 }
 
 // delConn deletes connection from the connections map or does nothing.
@@ -77,12 +113,61 @@ func (b *backend) delConn(fd int) {
 		return
 	default:
 	}
-	// delete connection fd from epoll
-	// delete connection from connection map
 	b.rmu.Lock()
-	defer b.rmu.Unlock()
-	b.epoller.Del(fd)
+	_, ok := b.connections[fd]
 	delete(b.connections, fd)
+	b.rmu.Unlock()
+	if ok {
+		b.release()
+	}
+}
+
+// reserve takes the connection slot for the new connection. It returns false if the backend is at max connections.
+func (b *backend) reserve() bool {
+	for {
+		slots := b.slots.Load()
+		if b.maxConns > 0 && slots >= int64(b.maxConns) {
+			return false
+		}
+		if b.slots.CompareAndSwap(slots, slots+1) {
+			return true
+		}
+	}
+}
+
+// release frees the connection slot, so the first client waiting in the app queue is woken up.
+func (b *backend) release() {
+	b.slots.Add(-1)
+	b.notify(false)
+}
+
+// full reports if the backend is at max connections.
+func (b *backend) full() bool {
+	return b.maxConns > 0 && b.slots.Load() >= int64(b.maxConns)
+}
+
+// BackendStats is the state of the backend.
+type BackendStats struct {
+	App         string
+	Address     string
+	Active      bool
+	Connections int
+	// LatencyMs is the peak EWMA of connect latency in milliseconds.
+	LatencyMs float64
+	// Failures is the EWMA of the failed connects share.
+	Failures float64
+}
+
+// stats returns the state of the backend.
+func (b *backend) stats(app string) BackendStats {
+	return BackendStats{
+		App:         app,
+		Address:     b.addr,
+		Active:      b.active.Load(),
+		Connections: b.getConnCount(),
+		LatencyMs:   b.latency.get() / float64(time.Millisecond),
+		Failures:    b.failures.get(),
+	}
 }
 
 // getConnCount returns connections count.
@@ -92,27 +177,17 @@ func (b *backend) getConnCount() int {
 	return len(b.connections)
 }
 
-// getConnByFD returns connection by its file descriptor.
-func (b *backend) getConnByFD(fd int) *PipedConn {
-	b.rmu.RLock()
-	defer b.rmu.RUnlock()
-	return b.connections[fd]
-}
-
 // run is a blocking function. It starts runHealthcheck goroutine.
 // It exits on ctx is done and closes all connections.
 func (b *backend) run(wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	go b.runHealthcheck()
-	go b.listenEpoll()
 
-	// waiting for the graceful shutdown. after this it closes epoll and connections
+	// waiting for the graceful shutdown. after this it closes connections
 	<-b.ctx.Done()
 	b.logger.Info().Str("backend", b.addr).Msg("closing connections")
 
-	b.epoller.Close()
-
 	b.rmu.RLock()
 	defer b.rmu.RUnlock()
 	for _, conn := range b.connections {
@@ -120,125 +195,131 @@ func (b *backend) run(wg *sync.WaitGroup) {
 	}
 }
 
-// runHealthcheck is blocking method. It is responsible for active health checks of the target backend.
-// It exits if backend ctx is done.
-func (b *backend) runHealthcheck() {
-	ticker := time.NewTicker(b.healthcheckInterval)
-	defer ticker.Stop()
-
-	// The first check is right after start
-	netConn, err := b.dialler.DialContext(b.ctx, "tcp", b.addr)
-	if err != nil {
-		b.setActive(false)
-	} else {
-		netConn.Close()
-		b.setActive(true)
+// observeConnect updates connect latency and failures averages. Connects interrupted by shutdown are skipped.
+// Failed connects are counted as connect timeouts.
+func (b *backend) observeConnect(start time.Time, timeout time.Duration, err error) {
+	if b.ctx.Err() != nil {
+		return
 	}
-
-	// infinite loop to check backend availability
-	for {
-		select {
-		case <-b.ctx.Done():
-			return
-		case <-ticker.C:
-			netConn, err = b.dialler.DialContext(b.ctx, "tcp", b.addr)
-			if err != nil {
-				b.setActive(false)
-				continue
-			}
-			netConn.Close()
-			b.setActive(true)
-		}
+	now := time.Now()
+	if err != nil {
+		b.latency.observe(float64(timeout), now)
+		b.failures.observe(1, now)
+		return
 	}
+	b.latency.observe(float64(now.Sub(start)), now)
+	b.failures.observe(0, now)
 }
 
-func (b *backend) listenEpoll() {
-	for {
-		select {
-		case <-b.ctx.Done():
-			return
-		default:
-		}
-		events, err := b.epoller.Wait()
-		if err != nil {
-			b.logger.Info().Err(err).Str("backend", b.addr).Msg("Wait()")
-			continue
-		}
-		for _, event := range events {
-			b.serveEvent(event)
-		}
+// resolve refreshes the resolved address of the backend. The previous address is kept on error.
+func (b *backend) resolve() {
+	raddr, err := net.ResolveTCPAddr("tcp", b.addr)
+	if err != nil {
+		b.logger.Info().Err(err).Str("backend", b.addr).Msg("ResolveTCPAddr()")
+		return
 	}
+	b.raddr.Store(raddr)
 }
 
 func (b *backend) setActive(t bool) {
 	if b.active.CompareAndSwap(!t, t) {
+		if t && b.checked.Load() {
+			b.recoveredAt.Store(time.Now().UnixNano())
+		}
 		b.logger.Info().Str("backend", b.addr).Bool("active", t).Msg("changed active status")
+		if t {
+			b.notify(true)
+		}
 	}
 }
 
-// createConn creates new net.Conn to the backend.
-func (b *backend) createConn() (net.Conn, error) {
-	conn, err := b.dialler.DialContext(b.ctx, "tcp", b.addr)
-	if err != nil {
-		// passive healthcheck
-		b.setActive(false)
-		return nil, errors.Wrap(err, "Dial()")
-	}
-	b.logger.Debug().Str("backend", b.addr).Str("connection", conn.LocalAddr().String()).Msg("new remote connection")
-	return conn, nil
-}
+const (
+	// weightScale is the number of effective weight units in one weight unit.
+	weightScale = 100
+	// slowStartMinPercent is the share of the full weight at the start of the slow-start window.
+	slowStartMinPercent = 10
+)
 
-// getBuf() returns buffer from the buffer pool.
-func (b *backend) getBuf() *[]byte {
-	buff, _ := b.bufPool.Get().(*[]byte)
-	return buff
+// effectiveWeight returns the weight in 1/weightScale units, which is used by balancers.
+// It rises linearly from 10% to the full weight during the slow-start window after recovery.
+func (b *backend) effectiveWeight() int {
+	full := b.weight * weightScale
+	recoveredAt := b.recoveredAt.Load()
+	if b.slowStart <= 0 || recoveredAt == 0 {
+		return full
+	}
+	elapsed := time.Since(time.Unix(0, recoveredAt))
+	if elapsed >= b.slowStart {
+		return full
+	}
+	percent := slowStartMinPercent + int(int64(100-slowStartMinPercent)*int64(elapsed)/int64(b.slowStart))
+	if w := b.weight * percent * weightScale / 100; w > 0 {
+		return w
+	}
+	return 1
 }
 
-// serveEvent checks the type of event and handles it.
-func (b *backend) serveEvent(event unix.EpollEvent) {
-	conn := b.getConnByFD(int(event.Fd))
-	if conn == nil {
-		return
+// createConn creates new remote connection to the backend. It blocks until timeout.
+// The connection slot reserved by the caller is released on error.
+func (b *backend) createConn(timeout time.Duration) (*Conn, error) {
+	start := time.Now()
+	fd, err := dial(b.ctx, b.addr, timeout)
+	b.observeConnect(start, timeout, err)
+	b.reportConnect(err)
+	if err != nil {
+		b.release()
+		return nil, errors.Wrap(err, "dial()")
 	}
-
-	if !conn.setUnderIO(true) {
-		return
+	b.logger.Debug().Str("backend", b.addr).Int("fd", fd).Msg("new remote connection")
+	conn, err := newConn(fd, b)
+	if err != nil {
+		b.release()
+		return nil, err
 	}
+	return conn, nil
+}
 
-	if event.Events&(unix.EPOLLHUP|unix.EPOLLRDHUP) != 0 {
-		go conn.finalizeOnce.Do(func() {
-			fmt.Println("back: because of event type unix.EPOLLHUP|unix.EPOLLRDHUP", event.Events)
-			b.logger.Debug().Msgf("closing connection %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
-			b.logger.Debug().Msgf("closing connection %s -> %s", conn.pipeTo.LocalAddr().String(), conn.pipeTo.RemoteAddr().String())
-			conn.finalize()
-		})
+// connect starts non-blocking connect to the backend in the reactor. The connect fails after timeout.
+// done is called once with the new remote connection or the error, it must not block.
+// The connection slot reserved by the caller is released on error.
+func (b *backend) connect(r *reactor, timeout time.Duration, done func(*Conn, error)) {
+	raddr := b.raddr.Load()
+	if raddr == nil {
+		b.release()
+		done(nil, errors.New("backend address is not resolved"))
 		return
 	}
-
-	// TODO use goroutine pool in the future
-	if event.Events&unix.EPOLLIN != 0 {
-		fmt.Println("back: because of event EPOLLIN", event.Events)
-		go b.serveConn(conn)
-	}
+	start := time.Now()
+	r.connect(raddr, timeout, func(fd int, err error) {
+		b.observeConnect(start, timeout, err)
+		b.reportConnect(err)
+		if err != nil {
+			b.release()
+			done(nil, errors.Wrap(err, "connect()"))
+			return
+		}
+		b.logger.Debug().Str("backend", b.addr).Int("fd", fd).Msg("new remote connection")
+		conn, err := newConn(fd, b)
+		if err != nil {
+			b.release()
+		}
+		done(conn, err)
+	})
 }
 
-// serveConn executes IO operation for connections.
+// serveConn executes IO operation for connections. It also continues IO operation of stalled connections.
 func (b *backend) serveConn(conn *PipedConn) {
-	buf := b.getBuf()
-	defer b.bufPool.Put(buf)
-
-	n, err := io.CopyBuffer(conn.pipeTo, conn, *buf)
-	conn.setUnderIO(false)
+	err := conn.serve(b.bufPool)
+	if err == nil || errors.Is(err, errStalled) {
+		return
+	}
 
-	if err != nil {
+	if !errors.Is(err, io.EOF) && !conn.pair.finalized.Load() {
 		b.logger.Info().Err(err).Msgf("can't copy data %s -> %s", conn.LocalAddr().String(), conn.pipeTo.RemoteAddr().String())
 	}
-	if err != nil || n == 0 {
-		conn.finalizeOnce.Do(func() {
-			b.logger.Debug().Msgf("closing connection %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
-			b.logger.Debug().Msgf("closing connection %s -> %s", conn.pipeTo.LocalAddr().String(), conn.pipeTo.RemoteAddr().String())
-			conn.finalize()
-		})
-		return
-	}
+	conn.pair.finalizeOnce.Do(func() {
+		b.logger.Debug().Msgf("closing connection %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
+		b.logger.Debug().Msgf("closing connection %s -> %s", conn.pipeTo.LocalAddr().String(), conn.pipeTo.RemoteAddr().String())
+		conn.finalize()
+	})
 }
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// balancer chooses the backend for a new connection. It is called concurrently by frontends of the app.
+// Balancers honour effective weights of backends, so backends with equal weights are treated equally,
+// and recovered backends get their share of new connections gradually during slow-start.
+// Balancers comparing loads of backends also skip recovered backends by admitted, because a recovered backend
+// has fewer connections than others and would get all new connections at once.
+type balancer interface {
+	// next returns one of active backends bnds for the client. bnds is never empty, and weights of its backends are positive.
+	next(bnds []*backend, client net.Addr) *backend
+}
+
+// newBalancer creates the balancer of backends bnds by its name. Empty name means "least-conn".
+// hashBy is the part of the client address used by "consistent-hash" balancer.
+func newBalancer(name string, hashBy string, bnds []*backend) (balancer, error) {
+	switch name {
+	case "", "least-conn":
+		return leastConn{}, nil
+	case "round-robin":
+		return &roundRobin{current: make(map[*backend]int)}, nil
+	case "random":
+		return random{}, nil
+	case "p2c":
+		return p2c{}, nil
+	case "least-latency":
+		return leastLatency{}, nil
+	case "peak-ewma":
+		return peakEWMA{}, nil
+	case "consistent-hash":
+		key, err := parseHashKey(hashBy)
+		if err != nil {
+			return nil, err
+		}
+		return &consistentHash{key: key, bnds: bnds}, nil
+	default:
+		return nil, errors.Errorf("unknown balancer %q", name)
+	}
+}
+
+// loadCmp compares the number of connections per weight unit of a and b. It returns -1, 0 or +1.
+// Connections include connecting ones, so a burst of new clients isn't sent to the same backend.
+func loadCmp(a, b *backend) int {
+	x := a.slots.Load() * int64(b.effectiveWeight())
+	y := b.slots.Load() * int64(a.effectiveWeight())
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// lessLoaded reports if the number of connections per weight unit of a is less than the one of b.
+func lessLoaded(a, b *backend) bool {
+	return loadCmp(a, b) < 0
+}
+
+// admitted reports if the backend takes the new connection. The backend in slow-start is skipped
+// with the probability falling from 90% to 0 during the slow-start window, so its admission rate ramps like its weight.
+func admitted(bnd *backend) bool {
+	full := bnd.weight * weightScale
+	weight := bnd.effectiveWeight()
+	return weight >= full || rand.Intn(full) < weight
+}
+
+// admittedBackends returns backends of bnds which are admitted. bnds are returned if none of them is admitted.
+func admittedBackends(bnds []*backend) []*backend {
+	res := bnds
+	skipped := false
+	for i, bnd := range bnds {
+		if admitted(bnd) {
+			if skipped {
+				res = append(res, bnd)
+			}
+			continue
+		}
+		if !skipped {
+			res = append(make([]*backend, 0, len(bnds)), bnds[:i]...)
+			skipped = true
+		}
+	}
+	if len(res) == 0 {
+		return bnds
+	}
+	return res
+}
+
+// leastConn chooses the backend with MIN number of connections per weight unit. Ties are broken randomly.
+type leastConn struct{}
+
+func (leastConn) next(bnds []*backend, _ net.Addr) *backend {
+	bnds = admittedBackends(bnds)
+	next := bnds[0]
+	ties := 1
+	for _, bnd := range bnds[1:] {
+		switch loadCmp(bnd, next) {
+		case -1:
+			next, ties = bnd, 1
+		case 0:
+			// every tied backend is kept with the probability 1/ties
+			ties++
+			if rand.Intn(ties) == 0 {
+				next = bnd
+			}
+		}
+	}
+	return next
+}
+
+// roundRobin is the smooth weighted round-robin (like in nginx).
+// Every backend gets its weight share of connections, and they are interleaved with connections of other backends.
+type roundRobin struct {
+	mu sync.Mutex
+	// current are current weights of backends.
+	current map[*backend]int
+}
+
+func (b *roundRobin) next(bnds []*backend, _ net.Addr) *backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var next *backend
+	total := 0
+	for _, bnd := range bnds {
+		weight := bnd.effectiveWeight()
+		b.current[bnd] += weight
+		total += weight
+		if next == nil || b.current[bnd] > b.current[next] {
+			next = bnd
+		}
+	}
+	b.current[next] -= total
+	return next
+}
+
+// random chooses the random backend with the probability proportional to its weight.
+type random struct{}
+
+func (random) next(bnds []*backend, _ net.Addr) *backend {
+	weights := make([]int, len(bnds))
+	total := 0
+	for i, bnd := range bnds {
+		weights[i] = bnd.effectiveWeight()
+		total += weights[i]
+	}
+	n := rand.Intn(total)
+	for i, weight := range weights {
+		n -= weight
+		if n < 0 {
+			return bnds[i]
+		}
+	}
+	return bnds[len(bnds)-1]
+}
+
+// p2c (power of two choices) chooses two random backends and takes the one with fewer connections per weight unit.
+type p2c struct{}
+
+func (p2c) next(bnds []*backend, _ net.Addr) *backend {
+	bnds = admittedBackends(bnds)
+	if len(bnds) == 1 {
+		return bnds[0]
+	}
+	i := rand.Intn(len(bnds))
+	j := rand.Intn(len(bnds) - 1)
+	if j >= i {
+		j++
+	}
+	if lessLoaded(bnds[j], bnds[i]) {
+		return bnds[j]
+	}
+	return bnds[i]
+}
+
+// leastLatency chooses the backend with MIN connect latency EWMA per weight unit.
+type leastLatency struct{}
+
+func (leastLatency) next(bnds []*backend, _ net.Addr) *backend {
+	bnds = admittedBackends(bnds)
+	next := bnds[0]
+	minCost := next.latency.get() / float64(next.effectiveWeight())
+	for _, bnd := range bnds[1:] {
+		if cost := bnd.latency.get() / float64(bnd.effectiveWeight()); cost < minCost {
+			next, minCost = bnd, cost
+		}
+	}
+	return next
+}
+
+// peakEWMA chooses two random backends and takes the one with the lower cost (like in Finagle and Linkerd).
+// The cost is connect latency EWMA multiplied by the number of connections plus one per weight unit,
+// so both slow and loaded backends get fewer connections.
+type peakEWMA struct{}
+
+func (peakEWMA) next(bnds []*backend, _ net.Addr) *backend {
+	bnds = admittedBackends(bnds)
+	if len(bnds) == 1 {
+		return bnds[0]
+	}
+	i := rand.Intn(len(bnds))
+	j := rand.Intn(len(bnds) - 1)
+	if j >= i {
+		j++
+	}
+	if peakEWMACost(bnds[j]) < peakEWMACost(bnds[i]) {
+		return bnds[j]
+	}
+	return bnds[i]
+}
+
+func peakEWMACost(bnd *backend) float64 {
+	return bnd.latency.get() * float64(bnd.slots.Load()+1) / float64(bnd.effectiveWeight())
+}
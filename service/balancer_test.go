@@ -0,0 +1,372 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// newTestBackend creates the active backend with the weight and conns reserved connections.
+func newTestBackend(t *testing.T, addr string, weight int, conns int) *backend {
+	t.Helper()
+	logger := zerolog.Nop()
+	bnd, err := newBackend(context.Background(), &logger, addr, backendConfig{weight: weight}, nil)
+	if err != nil {
+		t.Fatalf("newBackend(): %v", err)
+	}
+	bnd.slots.Store(int64(conns))
+	bnd.active.Store(true)
+	return bnd
+}
+
+// newTestBackends creates backends with weights and numbers of connections. Addresses are 10.0.0.<index>:80.
+func newTestBackends(t *testing.T, weights []int, conns []int) []*backend {
+	t.Helper()
+	bnds := make([]*backend, 0, len(weights))
+	for i, weight := range weights {
+		n := 0
+		if conns != nil {
+			n = conns[i]
+		}
+		bnds = append(bnds, newTestBackend(t, fmt.Sprintf("10.0.0.%d:80", i), weight, n))
+	}
+	return bnds
+}
+
+// startSlowStart makes the backend recovered elapsed ago with the slow-start window of one hour.
+func startSlowStart(bnd *backend, elapsed time.Duration) {
+	bnd.slowStart = time.Hour
+	bnd.recoveredAt.Store(time.Now().Add(-elapsed).UnixNano())
+}
+
+func backendIndex(bnds []*backend, bnd *backend) int {
+	for i, b := range bnds {
+		if b == bnd {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestLeastConn(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		conns   []int
+		want    int
+	}{
+		{name: "single", weights: []int{1}, conns: []int{7}, want: 0},
+		{name: "min is in the middle", weights: []int{1, 1, 1}, conns: []int{5, 3, 4}, want: 1},
+		{name: "min is the last", weights: []int{1, 1, 1}, conns: []int{5, 4, 3}, want: 2},
+		{name: "weighted", weights: []int{2, 1}, conns: []int{3, 2}, want: 0},
+		{name: "heavy backend is loaded", weights: []int{3, 1}, conns: []int{7, 2}, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bnds := newTestBackends(t, tt.weights, tt.conns)
+			got := backendIndex(bnds, leastConn{}.next(bnds, nil))
+			if got != tt.want {
+				t.Errorf("next() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeastConnTies(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		conns   []int
+		want    []int
+	}{
+		{name: "equal", weights: []int{1, 1, 1}, conns: []int{2, 2, 2}, want: []int{0, 1, 2}},
+		{name: "weighted", weights: []int{2, 1, 1}, conns: []int{4, 2, 3}, want: []int{0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bnds := newTestBackends(t, tt.weights, tt.conns)
+			counts := make([]int, len(bnds))
+			for i := 0; i < 300; i++ {
+				counts[backendIndex(bnds, leastConn{}.next(bnds, nil))]++
+			}
+			tied := 0
+			for _, i := range tt.want {
+				if counts[i] == 0 {
+					t.Errorf("counts = %v, backend %d never wins the tie", counts, i)
+				}
+				tied += counts[i]
+			}
+			if tied != 300 {
+				t.Errorf("counts = %v, want only backends %v", counts, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeastConnBurst(t *testing.T) {
+	// connects of the burst are pending, so established connections aren't counted yet
+	bnds := newTestBackends(t, []int{1, 1, 1}, nil)
+	var b leastConn
+	for i := 0; i < 30; i++ {
+		if !b.next(bnds, nil).reserve() {
+			t.Fatal("reserve() failed")
+		}
+	}
+	for i, bnd := range bnds {
+		if n := bnd.slots.Load(); n != 10 {
+			t.Errorf("backend %d has %d connections, want 10", i, n)
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		want    string
+	}{
+		{name: "equal", weights: []int{1, 1, 1}, want: "012012"},
+		{name: "nginx example", weights: []int{5, 1, 1}, want: "00102000010200"},
+		{name: "interleaved", weights: []int{3, 1}, want: "00100010"},
+		{name: "two heavy", weights: []int{2, 2, 1}, want: "0120101201"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bnds := newTestBackends(t, tt.weights, nil)
+			b, err := newBalancer("round-robin", "", bnds)
+			if err != nil {
+				t.Fatalf("newBalancer(): %v", err)
+			}
+			var got strings.Builder
+			for range tt.want {
+				fmt.Fprint(&got, backendIndex(bnds, b.next(bnds, nil)))
+			}
+			if got.String() != tt.want {
+				t.Errorf("sequence = %s, want %s", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestEffectiveWeight(t *testing.T) {
+	tests := []struct {
+		name      string
+		weight    int
+		slowStart bool
+		elapsed   time.Duration
+		want      int
+	}{
+		{name: "no slow-start", weight: 2, want: 200},
+		{name: "recovered now", weight: 2, slowStart: true, want: 20},
+		{name: "middle of window", weight: 2, slowStart: true, elapsed: 30 * time.Minute, want: 110},
+		{name: "after window", weight: 2, slowStart: true, elapsed: 2 * time.Hour, want: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bnd := newTestBackend(t, "10.0.0.1:80", tt.weight, 0)
+			if tt.slowStart {
+				startSlowStart(bnd, tt.elapsed)
+			}
+			if got := bnd.effectiveWeight(); got != tt.want {
+				t.Errorf("effectiveWeight() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeastConnSlowStart(t *testing.T) {
+	tests := []struct {
+		name     string
+		elapsed  time.Duration
+		min, max int
+	}{
+		// the admission rate is 10%, so about 100 of 1000 connections
+		{name: "recovered now", min: 50, max: 150},
+		// the admission rate is 55%
+		{name: "middle of window", elapsed: 30 * time.Minute, min: 450, max: 650},
+		{name: "after window", elapsed: 2 * time.Hour, min: 1000, max: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the recovered backend has no connections, others have 1000
+			bnds := newTestBackends(t, []int{1, 1, 1}, []int{0, 1000, 1000})
+			startSlowStart(bnds[0], tt.elapsed)
+			got := 0
+			for i := 0; i < 1000; i++ {
+				if (leastConn{}).next(bnds, nil) == bnds[0] {
+					got++
+				}
+			}
+			if got < tt.min || got > tt.max {
+				t.Errorf("recovered backend got %d of 1000 connections, want %d..%d", got, tt.min, tt.max)
+			}
+		})
+	}
+
+	t.Run("single backend", func(t *testing.T) {
+		bnds := newTestBackends(t, []int{1}, nil)
+		startSlowStart(bnds[0], 0)
+		for i := 0; i < 100; i++ {
+			if got := (leastConn{}).next(bnds, nil); got != bnds[0] {
+				t.Fatalf("next() = %v, want the only backend", got)
+			}
+		}
+	})
+}
+
+func TestRoundRobinSlowStart(t *testing.T) {
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		want    int
+	}{
+		// effective weights are 10 and 100 units
+		{name: "recovered now", want: 10},
+		// effective weights are 55 and 100 units
+		{name: "middle of window", elapsed: 30 * time.Minute, want: 39},
+		{name: "after window", elapsed: 2 * time.Hour, want: 55},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bnds := newTestBackends(t, []int{1, 1}, nil)
+			startSlowStart(bnds[0], tt.elapsed)
+			b, err := newBalancer("round-robin", "", bnds)
+			if err != nil {
+				t.Fatalf("newBalancer(): %v", err)
+			}
+			got := 0
+			for i := 0; i < 110; i++ {
+				if b.next(bnds, nil) == bnds[0] {
+					got++
+				}
+			}
+			if got != tt.want {
+				t.Errorf("recovered backend got %d of 110 connections, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRandomHonoursWeights(t *testing.T) {
+	bnds := newTestBackends(t, []int{3, 1}, nil)
+	counts := make([]int, len(bnds))
+	for i := 0; i < 40000; i++ {
+		counts[backendIndex(bnds, random{}.next(bnds, nil))]++
+	}
+	// the expected share of the first backend is 30000, the deviation is about 90
+	if counts[0] < 29000 || counts[0] > 31000 {
+		t.Errorf("counts = %v, want about [30000 10000]", counts)
+	}
+}
+
+func TestP2C(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		conns   []int
+		want    int
+	}{
+		{name: "single", weights: []int{1}, conns: []int{3}, want: 0},
+		{name: "less loaded", weights: []int{1, 1}, conns: []int{5, 1}, want: 1},
+		{name: "weighted", weights: []int{4, 1}, conns: []int{7, 2}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bnds := newTestBackends(t, tt.weights, tt.conns)
+			// two backends are always both chosen, so the result is deterministic
+			for i := 0; i < 100; i++ {
+				if got := backendIndex(bnds, p2c{}.next(bnds, nil)); got != tt.want {
+					t.Fatalf("next() = %d, want %d", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLeastLatency(t *testing.T) {
+	tests := []struct {
+		name      string
+		weights   []int
+		latencies []time.Duration
+		want      int
+	}{
+		{name: "fastest", weights: []int{1, 1, 1}, latencies: []time.Duration{3 * time.Millisecond, time.Millisecond, 2 * time.Millisecond}, want: 1},
+		{name: "weighted", weights: []int{4, 1}, latencies: []time.Duration{3 * time.Millisecond, time.Millisecond}, want: 0},
+	}
+	now := time.Now()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bnds := newTestBackends(t, tt.weights, nil)
+			for i, latency := range tt.latencies {
+				bnds[i].latency.observe(float64(latency), now)
+			}
+			if got := backendIndex(bnds, leastLatency{}.next(bnds, nil)); got != tt.want {
+				t.Errorf("next() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeakEWMA(t *testing.T) {
+	type sample struct {
+		backend int
+		latency time.Duration
+		at      time.Duration
+	}
+	// samples every second during a minute
+	recovery := make([]sample, 0, 61)
+	recovery = append(recovery, sample{0, 10 * time.Millisecond, 0}, sample{1, 1500 * time.Microsecond, 0})
+	for i := 1; i <= 60; i++ {
+		recovery = append(recovery, sample{0, time.Millisecond, time.Duration(i) * time.Second})
+	}
+	tests := []struct {
+		name    string
+		weights []int
+		conns   []int
+		samples []sample
+		want    int
+	}{
+		{name: "faster", weights: []int{1, 1}, conns: []int{0, 0}, samples: []sample{{0, time.Millisecond, 0}, {1, 3 * time.Millisecond, 0}}, want: 0},
+		{name: "loaded faster", weights: []int{1, 1}, conns: []int{5, 0}, samples: []sample{{0, time.Millisecond, 0}, {1, 3 * time.Millisecond, 0}}, want: 1},
+		{name: "weighted loaded faster", weights: []int{3, 1}, conns: []int{5, 0}, samples: []sample{{0, time.Millisecond, 0}, {1, 3 * time.Millisecond, 0}}, want: 0},
+		{
+			name: "peak is noticed at once", weights: []int{1, 1}, conns: []int{0, 0},
+			samples: []sample{{0, time.Millisecond, 0}, {1, 1500 * time.Microsecond, 0}, {0, time.Millisecond, time.Second}, {0, 10 * time.Millisecond, time.Second}},
+			want:    1,
+		},
+		{name: "peak is forgotten", weights: []int{1, 1}, conns: []int{0, 0}, samples: recovery, want: 0},
+	}
+	start := time.Unix(1000, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bnds := newTestBackends(t, tt.weights, tt.conns)
+			for _, s := range tt.samples {
+				bnds[s.backend].latency.observe(float64(s.latency), start.Add(s.at))
+			}
+			// two backends are always both chosen, so the result is deterministic
+			for i := 0; i < 100; i++ {
+				if got := backendIndex(bnds, peakEWMA{}.next(bnds, nil)); got != tt.want {
+					t.Fatalf("next() = %d, want %d", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewBalancer(t *testing.T) {
+	for _, name := range []string{"", "least-conn", "round-robin", "random", "p2c", "least-latency", "peak-ewma", "consistent-hash"} {
+		if _, err := newBalancer(name, "", nil); err != nil {
+			t.Errorf("newBalancer(%q): %v", name, err)
+		}
+	}
+	if _, err := newBalancer("fastest", "", nil); err == nil {
+		t.Error("newBalancer() of unknown balancer didn't fail")
+	}
+	if _, err := newBalancer("consistent-hash", "port", nil); err == nil {
+		t.Error("newBalancer() with unknown hash key didn't fail")
+	}
+}
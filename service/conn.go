@@ -1,78 +1,288 @@
 package service
 
 import (
+	"io"
 	"net"
-	"reflect"
 	"sync"
 	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
+// connManager is the frontend or the backend of the connection.
 type connManager interface {
 	addConn(*PipedConn)
 	delConn(int)
+	serveConn(*PipedConn)
 }
 
-// Conn is the net.Conn wrapper that contains also information about its file descriptor and connManager.
+var (
+	errStalled  = errors.New("connection is stalled")
+	errDetached = errors.New("connection is detached from reactor")
+)
+
+// Conn is the raw non-blocking socket that contains also information about its addresses and connManager.
+// The socket is owned by Conn, it isn't served by Go runtime netpoller.
 type Conn struct {
-	net.Conn
-	fd      int
+	fd int
+	// wfd is the duplicate of fd registered in the poller for writing readiness. It is created on the first stall.
+	// The separate registration allows to wait for writing readiness while fd is disabled for reading.
+	// It is protected by rmu of the reactor.
+	wfd     int
+	laddr   net.Addr
+	raddr   net.Addr
 	closed  atomic.Bool
 	manager connManager
+	// reactor serves poller events of the connection. It is nil in io_uring mode.
+	reactor *reactor
 }
 
-func newConn(conn net.Conn, manager connManager) *Conn {
+// newConn creates Conn from the connected socket fd. It takes ownership of fd, so fd is closed on error.
+func newConn(fd int, manager connManager) (*Conn, error) {
+	lsa, err := unix.Getsockname(fd)
+	if err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrap(err, "Getsockname()")
+	}
+	rsa, err := unix.Getpeername(fd)
+	if err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrap(err, "Getpeername()")
+	}
 	return &Conn{
-		Conn:    conn,
-		fd:      fdFromConn(conn),
+		fd:      fd,
+		wfd:     -1,
+		laddr:   tcpAddr(lsa),
+		raddr:   tcpAddr(rsa),
 		manager: manager,
-	}
+	}, nil
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
 }
 
-// Close closes net.Conn and prevents repeated connection close.
+// Close closes the socket and prevents repeated connection close.
 func (c *Conn) Close() error {
 	if c.closed.CompareAndSwap(false, true) {
-		return c.Conn.Close()
+		c.closeWfd()
+		return unix.Close(c.fd)
 	}
 	return nil
 }
 
+// closeWfd closes wfd if it was created. wfd exists only in reactor mode, and it is read under rmu of the reactor,
+// because it is created by the goroutine of the stalled connection.
+func (c *Conn) closeWfd() {
+	if c.reactor == nil {
+		return
+	}
+	c.reactor.rmu.Lock()
+	defer c.reactor.rmu.Unlock()
+	if c.wfd >= 0 {
+		unix.Close(c.wfd)
+		c.wfd = -1
+	}
+}
+
 // PipedConn is the Conn wrapper (A-leg) that contains information about B-leg connection.
 // This is directional entity. A-leg is the connection for reading. B-leg is the connection for writing.
+//
+// A-leg fd is registered in the poller with OneShot interest, so the event disables it,
+// and only one goroutine relays data of PipedConn. This goroutine rearms A-leg fd after reading until EAGAIN.
+// The stalled PipedConn keeps A-leg fd disabled until B-leg becomes writable, and the goroutine of the writing event continues relaying.
 type PipedConn struct {
 	*Conn
-	pipeTo       *Conn
-	finalizeOnce *sync.Once
-	underIO      atomic.Bool
+	pipeTo *Conn
+	pair   *connPair
+	// reverse is the PipedConn of the opposite direction.
+	reverse *PipedConn
+	// stalled is set while B-leg can't accept data. buf and backlog keep data which wasn't written yet.
+	stalled atomic.Bool
+	buf     *[]byte
+	backlog []byte
+	// pipes is set in splice relay mode. pipe keeps data of the stalled connection in this mode.
+	pipes *pipePool
+	pipe  *pipe
 }
 
-func newPiped(conn *Conn, out *Conn, finalizeOnce *sync.Once) *PipedConn {
+// connPair is shared by both directions of the proxied connection.
+type connPair struct {
+	finalizeOnce sync.Once
+	// finalized is set by finalize. IO errors of the finalized pair are caused by its shutdown.
+	finalized atomic.Bool
+	// refs is the number of references to fds of both legs: the reference of the pair itself until finalize,
+	// and the reference of every dispatched IO operation. fds are closed when the last reference is released,
+	// because closed fd numbers can be reused by new connections right away.
+	refs atomic.Int32
+}
+
+func newConnPair() *connPair {
+	pair := &connPair{}
+	pair.refs.Store(1)
+	return pair
+}
+
+func newPiped(conn *Conn, out *Conn, pair *connPair, pipes *pipePool) *PipedConn {
 	return &PipedConn{
-		Conn:         conn,
-		pipeTo:       out,
-		finalizeOnce: finalizeOnce,
+		Conn:   conn,
+		pipeTo: out,
+		pair:   pair,
+		pipes:  pipes,
 	}
 }
 
-// finalize closes A- and B-leg connections and deletes them from connManager.
+// finalize shuts down A- and B-leg sockets and deletes them from connManager and the reactor.
+// The shutdown makes IO of the opposite direction fail soon. Sockets are closed by the last release.
 func (c *PipedConn) finalize() {
-	c.setUnderIO(false)
-	c.Close()
-	c.pipeTo.Close()
+	c.pair.finalized.Store(true)
+	_ = unix.Shutdown(c.fd, unix.SHUT_RDWR)
+	_ = unix.Shutdown(c.pipeTo.fd, unix.SHUT_RDWR)
 	c.pipeTo.manager.delConn(c.pipeTo.fd)
 	c.manager.delConn(c.fd)
+	if c.reactor != nil {
+		c.pipeTo.reactor.detach(c.pipeTo)
+		c.reactor.detach(c.Conn)
+	}
+	c.release()
 }
 
-// setUnderIO can be used to change the state. Also, it returns result if the value was changed.
-// If we set true and it was true, this method returns false.
-// If we set true and it was false, this method returns true.
-func (c *PipedConn) setUnderIO(underIO bool) bool {
-	return c.underIO.CompareAndSwap(!underIO, underIO)
+// acquire takes the reference to fds of the pair for the dispatched IO operation.
+// The reactor calls it under rmu, so the connection can't be detached at the same time.
+func (c *PipedConn) acquire() {
+	c.pair.refs.Add(1)
 }
 
-// fdFromConn extracts fd from net.Conn.
-func fdFromConn(conn net.Conn) int {
-	tcpConn := reflect.Indirect(reflect.ValueOf(conn)).FieldByName("conn")
-	fdVal := tcpConn.FieldByName("fd")
-	pfdVal := reflect.Indirect(fdVal).FieldByName("pfd")
-	return int(pfdVal.FieldByName("Sysfd").Int())
+// release drops the reference to fds of the pair. The last reference closes A- and B-leg connections.
+// In reactor mode they are closed by the reactor after its current batch of events.
+func (c *PipedConn) release() {
+	if c.pair.refs.Add(-1) > 0 {
+		return
+	}
+	// the stalled connection of the finalized pair is not served anymore
+	c.releasePipe()
+	if c.reverse != nil {
+		c.reverse.releasePipe()
+	}
+	if c.reactor != nil {
+		c.reactor.closeLater(c.Conn, c.pipeTo)
+		return
+	}
+	c.Close()
+	c.pipeTo.Close()
+}
+
+// serve relays data from A-leg to B-leg until A-leg has no data to read and rearms A-leg fd.
+// It returns errStalled if B-leg can't accept data now. A-leg fd stays disabled until B-leg becomes writable.
+// It returns io.EOF if A-leg was closed by the peer, or another error if IO failed.
+// In these cases A-leg fd stays disabled, and the connection has to be finalized.
+func (c *PipedConn) serve(bufPool *sync.Pool) error {
+	if c.pipes != nil {
+		return c.serveSplice()
+	}
+
+	buf, backlog := c.buf, c.backlog
+	c.buf, c.backlog = nil, nil
+	if buf == nil {
+		buf, _ = bufPool.Get().(*[]byte)
+	}
+
+	err := c.resume(buf, backlog)
+	if err == nil {
+		err = c.relay(buf)
+	}
+
+	if !errors.Is(err, errStalled) {
+		bufPool.Put(buf)
+	}
+	if err != nil {
+		return err
+	}
+	// rearm is the last operation with the connection, because the next event can be served right after it
+	return c.reactor.rearm(c.fd)
+}
+
+// resume writes backlog of the stalled connection to B-leg.
+func (c *PipedConn) resume(buf *[]byte, backlog []byte) error {
+	if backlog == nil {
+		return nil
+	}
+	return c.write(buf, backlog)
+}
+
+// relay reads A-leg raw non-blocking fd until EAGAIN and writes data to B-leg.
+func (c *PipedConn) relay(buf *[]byte) error {
+	for {
+		n, err := unix.Read(c.fd, *buf)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			if err == unix.EAGAIN {
+				return nil
+			}
+			return errors.Wrap(err, "Read()")
+		}
+		if n == 0 {
+			return io.EOF
+		}
+		if err := c.write(buf, (*buf)[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+// write writes data to B-leg. If B-leg can't accept all data, the rest of data is kept and the connection is stalled.
+func (c *PipedConn) write(buf *[]byte, data []byte) error {
+	n, err := c.pipeTo.write(data)
+	if err == unix.EAGAIN {
+		return c.stall(buf, data[n:])
+	}
+	return err
+}
+
+// stall stops relaying until B-leg becomes writable.
+// buf is kept by the connection until the backlog is written.
+func (c *PipedConn) stall(buf *[]byte, backlog []byte) error {
+	c.buf, c.backlog = buf, backlog
+	c.stalled.Store(true)
+	if err := c.reactor.awaitWritable(c); err != nil {
+		c.stalled.Store(false)
+		c.buf, c.backlog, c.pipe = nil, nil, nil
+		return err
+	}
+	return errStalled
+}
+
+// unstall is called when B-leg becomes writable.
+// It returns true if the connection was stalled, so it has to be served again.
+func (c *PipedConn) unstall() bool {
+	return c.stalled.CompareAndSwap(true, false)
+}
+
+// write writes data to the raw non-blocking fd.
+// It returns unix.EAGAIN with the number of written bytes if the socket send buffer is full.
+func (c *Conn) write(data []byte) (int, error) {
+	var written int
+	for written < len(data) {
+		n, err := unix.Write(c.fd, data[written:])
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			if err == unix.EAGAIN {
+				return written, err
+			}
+			return written, errors.Wrap(err, "Write()")
+		}
+		written += n
+	}
+	return written, nil
 }
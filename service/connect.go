@@ -0,0 +1,163 @@
+package service
+
+import (
+	"container/heap"
+	"net"
+	"time"
+
+	"github.com/hotafrika/tcp_proxy_epoll/pkg/poller"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// pendingConnect is the non-blocking connect which waits for completion in the reactor.
+type pendingConnect struct {
+	fd       int
+	deadline time.Time
+	// done is called in the reactor goroutine with the connected fd or the error.
+	done func(fd int, err error)
+	// index is the index of the connect in the timers heap.
+	index int
+}
+
+// connectTimers is the min-heap of pending connects by deadline.
+type connectTimers []*pendingConnect
+
+func (t connectTimers) Len() int           { return len(t) }
+func (t connectTimers) Less(i, j int) bool { return t[i].deadline.Before(t[j].deadline) }
+func (t connectTimers) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+	t[i].index = i
+	t[j].index = j
+}
+
+func (t *connectTimers) Push(x any) {
+	pc := x.(*pendingConnect)
+	pc.index = len(*t)
+	*t = append(*t, pc)
+}
+
+func (t *connectTimers) Pop() any {
+	old := *t
+	pc := old[len(old)-1]
+	old[len(old)-1] = nil
+	*t = old[:len(old)-1]
+	return pc
+}
+
+// connect starts non-blocking connect to the address. The completion is awaited with Writable interest,
+// and the timeout is driven by the reactor timer, so no goroutine waits for the connection.
+// done is called once with the connected non-blocking fd or the error.
+func (r *reactor) connect(addr *net.TCPAddr, timeout time.Duration, done func(fd int, err error)) {
+	// the poller is closed after the reactor is stopped
+	if r.ctx.Err() != nil {
+		done(-1, errors.Wrap(r.ctx.Err(), "reactor is stopped"))
+		return
+	}
+	fd, err := connectSocket(addr)
+	if err == nil {
+		done(fd, nil)
+		return
+	}
+	if err != unix.EINPROGRESS {
+		done(-1, errors.Wrap(err, "Connect()"))
+		return
+	}
+
+	pc := &pendingConnect{
+		fd:       fd,
+		deadline: time.Now().Add(timeout),
+		done:     done,
+	}
+	r.cmu.Lock()
+	r.connects[fd] = pc
+	heap.Push(&r.timers, pc)
+	r.resetTimer()
+	err = r.poller.Add(fd, poller.Writable|poller.OneShot)
+	if err != nil {
+		r.dropConnect(pc)
+	}
+	r.cmu.Unlock()
+
+	if err != nil {
+		unix.Close(fd)
+		done(-1, errors.Wrap(err, "Add()"))
+	}
+}
+
+// completeConnect checks the result of the connect on its fd event.
+// It returns false if fd isn't the pending connect.
+func (r *reactor) completeConnect(fd int) bool {
+	r.cmu.Lock()
+	pc, ok := r.connects[fd]
+	if ok {
+		r.dropConnect(pc)
+		r.poller.Del(fd)
+	}
+	r.cmu.Unlock()
+	if !ok {
+		return false
+	}
+
+	soErr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err == nil && soErr != 0 {
+		err = unix.Errno(soErr)
+	}
+	if err != nil {
+		unix.Close(fd)
+		pc.done(-1, errors.Wrap(err, "Connect()"))
+		return true
+	}
+	pc.done(fd, nil)
+	return true
+}
+
+// expireConnects fails pending connects with passed deadline. With abort it fails all pending connects.
+func (r *reactor) expireConnects(now time.Time, abort error) {
+	var expired []*pendingConnect
+	r.cmu.Lock()
+	for len(r.timers) > 0 && (abort != nil || !r.timers[0].deadline.After(now)) {
+		pc := r.timers[0]
+		r.dropConnect(pc)
+		r.poller.Del(pc.fd)
+		expired = append(expired, pc)
+	}
+	if abort == nil {
+		r.resetTimer()
+	}
+	r.cmu.Unlock()
+
+	for _, pc := range expired {
+		unix.Close(pc.fd)
+		err := abort
+		if err == nil {
+			err = unix.ETIMEDOUT
+		}
+		pc.done(-1, errors.Wrap(err, "Connect()"))
+	}
+}
+
+// dropConnect deletes the pending connect. cmu must be held by the caller.
+func (r *reactor) dropConnect(pc *pendingConnect) {
+	delete(r.connects, pc.fd)
+	heap.Remove(&r.timers, pc.index)
+}
+
+// resetTimer sets the reactor timer to the nearest deadline. The timer wakes up the reactor goroutine,
+// which expires pending connects. cmu must be held by the caller.
+func (r *reactor) resetTimer() {
+	if len(r.timers) == 0 {
+		return
+	}
+	deadline := r.timers[0].deadline
+	if r.timer == nil {
+		r.timer = time.AfterFunc(time.Until(deadline), func() {
+			_ = r.poller.Wake()
+		})
+	} else if deadline.Equal(r.timerAt) {
+		return
+	} else {
+		r.timer.Reset(time.Until(deadline))
+	}
+	r.timerAt = deadline
+}
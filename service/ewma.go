@@ -0,0 +1,42 @@
+package service
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// latencyDecay is the time constant of connect latency and failure averages of backends.
+const latencyDecay = 10 * time.Second
+
+// ewma is the exponentially weighted moving average with time-based decay: the weight of the old value depends on
+// the time since the previous sample, not on the number of samples.
+type ewma struct {
+	mu    sync.Mutex
+	value float64
+	stamp time.Time
+	// peak makes the average jump to samples which are greater than the average (like peak-EWMA in Finagle),
+	// so a slow backend is noticed at once and is forgotten gradually.
+	peak bool
+}
+
+// observe adds the sample.
+func (e *ewma) observe(sample float64, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stamp.IsZero() || (e.peak && sample > e.value) {
+		e.value = sample
+		e.stamp = now
+		return
+	}
+	w := math.Exp(-float64(now.Sub(e.stamp)) / float64(latencyDecay))
+	e.value = e.value*w + sample*(1-w)
+	e.stamp = now
+}
+
+// get returns the average.
+func (e *ewma) get() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.value
+}
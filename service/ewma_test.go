@@ -0,0 +1,43 @@
+package service
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEWMA(t *testing.T) {
+	type sample struct {
+		value float64
+		at    time.Duration
+	}
+	tests := []struct {
+		name    string
+		peak    bool
+		samples []sample
+		want    float64
+	}{
+		{name: "first sample", samples: []sample{{100, 0}}, want: 100},
+		{name: "same time", samples: []sample{{100, 0}, {200, 0}}, want: 100},
+		{name: "one time constant", samples: []sample{{100, 0}, {200, latencyDecay}}, want: 100*math.Exp(-1) + 200*(1-math.Exp(-1))},
+		{name: "two steps decay like one", samples: []sample{{100, 0}, {200, latencyDecay / 2}, {200, latencyDecay}}, want: 100*math.Exp(-1) + 200*(1-math.Exp(-1))},
+		{name: "old value is forgotten", samples: []sample{{100, 0}, {200, 100 * latencyDecay}}, want: 200},
+		{name: "lower sample", samples: []sample{{200, 0}, {100, latencyDecay}}, want: 200*math.Exp(-1) + 100*(1-math.Exp(-1))},
+		{name: "peak jumps to greater sample", peak: true, samples: []sample{{100, 0}, {300, 0}}, want: 300},
+		{name: "peak ignores lower sample at the same time", peak: true, samples: []sample{{300, 0}, {100, 0}}, want: 300},
+		{name: "peak decays", peak: true, samples: []sample{{300, 0}, {100, latencyDecay}}, want: 300*math.Exp(-1) + 100*(1-math.Exp(-1))},
+		{name: "peak decay restarts from the jump", peak: true, samples: []sample{{100, 0}, {300, latencyDecay}, {100, 2 * latencyDecay}}, want: 300*math.Exp(-1) + 100*(1-math.Exp(-1))},
+	}
+	start := time.Unix(1000, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := ewma{peak: tt.peak}
+			for _, s := range tt.samples {
+				e.observe(s.value, start.Add(s.at))
+			}
+			if got := e.get(); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("get() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -5,11 +5,9 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/hotafrika/tcp_proxy_epoll/pkg/epoll"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"golang.org/x/sys/unix"
@@ -21,32 +19,53 @@ type frontend struct {
 	logger      *zerolog.Logger
 	app         *application
 	laddr       *net.TCPAddr
-	tcpListener *net.TCPListener
+	listeners   []*listener
+	reusePort   bool
 	rmu         sync.RWMutex
 	connections map[int]*PipedConn
 	bufPool     *sync.Pool
-	epoller     *epoll.Epoll
+	reactors    *reactorPool
 }
 
 var _ connManager = (*frontend)(nil)
 
-func newFrontend(ctx context.Context, logger *zerolog.Logger, port int, app *application, bufPool *sync.Pool) (*frontend, error) {
+// newFrontend creates the frontend with one listener or listenerCount SO_REUSEPORT listeners.
+// Every SO_REUSEPORT listener is tied to its own reactor (or ring in io_uring mode).
+func newFrontend(ctx context.Context, logger *zerolog.Logger, port int, app *application, bufPool *sync.Pool, reactors *reactorPool, newRing func() (*uringRelay, error), listenerCount int) (*frontend, error) {
 	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, errors.Wrap(err, "ResolveTCPAddr()")
 	}
-	epoller, err := epoll.New()
-	if err != nil {
-		return nil, errors.Wrap(err, "New()")
+	reusePort := listenerCount > 0
+	if !reusePort {
+		listenerCount = 1
+	}
+	listeners := make([]*listener, 0, listenerCount)
+	for i := 0; i < listenerCount; i++ {
+		l := &listener{}
+		if newRing != nil {
+			l.ring, err = newRing()
+			if err != nil {
+				for _, l := range listeners {
+					l.ring.Close()
+				}
+				return nil, errors.Wrap(err, "newRing()")
+			}
+		} else if reusePort {
+			l.reactor = reactors.next()
+		}
+		listeners = append(listeners, l)
 	}
 	return &frontend{
 		ctx:         ctx,
 		logger:      logger,
 		app:         app,
 		laddr:       addr,
+		listeners:   listeners,
+		reusePort:   reusePort,
 		connections: make(map[int]*PipedConn),
 		bufPool:     bufPool,
-		epoller:     epoller,
+		reactors:    reactors,
 	}, nil
 }
 
@@ -57,12 +76,9 @@ func (f *frontend) addConn(conn *PipedConn) {
 		conn.Close()
 	default:
 	}
-	// add connection to the connection map
-	// add connection fd to epoll
 	f.rmu.Lock()
 	defer f.rmu.Unlock()
 	f.connections[conn.fd] = conn
-	f.epoller.Add(conn.fd)
 }
 
 // delConn deletes connection from the connections map or does nothing.
@@ -72,175 +88,235 @@ func (f *frontend) delConn(fd int) {
 		return
 	default:
 	}
-	// delete connection fd from epoll
-	// delete connection from connection map
 	f.rmu.Lock()
 	defer f.rmu.Unlock()
-	f.epoller.Del(fd)
 	delete(f.connections, fd)
 }
 
-// getConnByFD returns connection by its file descriptor.
-func (f *frontend) getConnByFD(fd int) *PipedConn {
-	f.rmu.RLock()
-	defer f.rmu.RUnlock()
-	return f.connections[fd]
-}
-
-// run is a blocking function. It tries to create tcpListener.
-// It starts listenForNewConn goroutine.
-// It exits on ctx is done and closes tcpListener and all connections.
-func (f *frontend) run(wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	// trying to create TCP listener in the loop
+// run is a blocking function. It tries to create listening sockets.
+// It registers listening sockets in reactors (or starts listenRing goroutine for every listener in io_uring mode).
+// It exits on ctx is done and closes listening sockets and all connections.
+// It returns the error if listening sockets can't be registered, so the proxy is failed.
+func (f *frontend) run() error {
+	// trying to create listening sockets in the loop
 	for {
 		select {
 		case <-f.ctx.Done():
-			return
+			return nil
 		default:
 		}
-		tcpListener, err := net.ListenTCP("tcp", f.laddr)
+		err := f.listen()
 		if err != nil {
-			f.logger.Error().Err(err).Str("frontend", f.laddr.String()).Msg("ListenTCP()")
+			f.logger.Error().Err(err).Str("frontend", f.laddr.String()).Msg("listen()")
 			time.Sleep(5 * time.Second)
 			continue
 		}
-		f.tcpListener = tcpListener
 		break
 	}
 
-	go f.listenEpoll()
-	go f.listenForNewConn()
+	// listeners are registered in reactors before rings are started, so nothing has to be stopped on error
+	var err error
+	for _, l := range f.listeners {
+		if l.ring != nil {
+			continue
+		}
+		l := l
+		accept := func() error {
+			return f.acceptConns(l)
+		}
+		for _, r := range f.listenerReactors(l) {
+			err = r.addListener(l.fd, l.reactor == nil && len(f.reactors.reactors) > 1, accept)
+			if err != nil {
+				err = errors.Wrapf(err, "addListener() of frontend %s", f.laddr.String())
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
 
-	// waiting for the graceful shutdown. After this it closes the listener, epoll and connections
-	<-f.ctx.Done()
-	f.logger.Info().Str("frontend", f.laddr.String()).Msg("closing listener and connections")
+	var ringsWg sync.WaitGroup
+	if err == nil {
+		for _, l := range f.listeners {
+			if l.ring != nil {
+				ringsWg.Add(1)
+				go f.listenRing(l, &ringsWg)
+			}
+		}
+		// waiting for the graceful shutdown. After this it closes listening sockets, rings and connections
+		<-f.ctx.Done()
+		f.logger.Info().Str("frontend", f.laddr.String()).Msg("closing listener and connections")
+	}
 
-	f.tcpListener.Close()
-	f.epoller.Close()
+	// rings are closed only after their goroutines exit
+	ringsWg.Wait()
+	for _, l := range f.listeners {
+		if l.ring != nil {
+			l.ring.Close()
+		} else {
+			for _, r := range f.listenerReactors(l) {
+				r.delListener(l.fd)
+			}
+		}
+		unix.Close(l.fd)
+	}
 
 	f.rmu.RLock()
 	defer f.rmu.RUnlock()
 	for _, conn := range f.connections {
 		conn.Close()
 	}
+	return err
 }
 
-// listenForNewConn is a blocking function. It is responsible for accepting new incoming connections.
-func (f *frontend) listenForNewConn() {
-	for {
-		select {
-		case <-f.ctx.Done():
-			return
-		default:
-		}
-		netConn, err := f.tcpListener.AcceptTCP()
+// listen creates listening sockets of all frontend listeners. Already created sockets are closed on error.
+func (f *frontend) listen() error {
+	for i, l := range f.listeners {
+		fd, err := listenSocket(f.laddr, f.reusePort)
 		if err != nil {
-			if strings.Contains(err.Error(), "use of closed network connection") {
-				break
+			for _, l := range f.listeners[:i] {
+				unix.Close(l.fd)
 			}
-			f.logger.Info().Err(err).Str("frontend", f.laddr.String()).Msg("AcceptTCP()")
-			continue
+			return err
 		}
+		l.fd = fd
+	}
+	return nil
+}
 
-		f.logger.Debug().Str("frontend", f.laddr.String()).Str("connection", netConn.RemoteAddr().String()).Msg("accepted new connection")
-
-		go f.handleNewConnection(netConn)
+// listenerReactors returns reactors which accept connections of the listener.
+// The listener which isn't tied to the reactor is shared by all reactors.
+func (f *frontend) listenerReactors(l *listener) []*reactor {
+	if l.reactor != nil {
+		return []*reactor{l.reactor}
 	}
+	return f.reactors.reactors
 }
 
-func (f *frontend) listenEpoll() {
+// acceptConns accepts new incoming connections of the listener until EAGAIN. Failed connections are skipped.
+// It is called by the reactor on the listener event, so it must not block.
+// It returns errFdExhausted if there are no free fds, so the reactor pauses the listener,
+// and the error if the listening socket is broken.
+func (f *frontend) acceptConns(l *listener) error {
 	for {
-		select {
-		case <-f.ctx.Done():
-			return
-		default:
-		}
-		events, err := f.epoller.Wait()
+		fd, err := accept(l.fd)
 		if err != nil {
-			f.logger.Info().Err(err).Str("frontend", f.laddr.String()).Msg("Wait()")
-			continue
-		}
-		for _, event := range events {
-			f.serveEvent(event)
+			switch err {
+			case unix.EINTR, unix.ECONNABORTED:
+				continue
+			case unix.EAGAIN:
+				// there are no more connections, or another reactor accepted them
+				return nil
+			case unix.EMFILE, unix.ENFILE, unix.ENOBUFS, unix.ENOMEM:
+				return errors.Wrapf(errFdExhausted, "accept() of frontend %s: %v", f.laddr.String(), err)
+			case unix.EBADF, unix.EINVAL, unix.ENOTSOCK, unix.EOPNOTSUPP, unix.EFAULT:
+				// the listening socket itself is broken, so accepting again would fail the same way
+				return errors.Wrapf(err, "accept() of frontend %s", f.laddr.String())
+			default:
+				// the error of the pending connection (like EPROTO or EPERM), which is dequeued anyway.
+				// The next connections have to be accepted now, because the edge-triggered event isn't reported again
+				f.logger.Info().Err(err).Str("frontend", f.laddr.String()).Msg("accept()")
+				continue
+			}
 		}
+		f.handleAcceptedFd(fd, l)
 	}
 }
 
-// handleNewConnection processes new incoming connections. It tries to find available backend and create remote connection.
-// This function creates two PipedConn for every direction of io operation.
-func (f *frontend) handleNewConnection(netConn *net.TCPConn) {
-	// creating a remote connection Conn
-	rConn, err := f.app.createRemoteConnection()
+// listenRing is a blocking function. It accepts new incoming connections of the listener
+// and serves IO operations with io_uring until ctx is done.
+func (f *frontend) listenRing(l *listener, wg *sync.WaitGroup) {
+	defer wg.Done()
+	err := l.ring.run(l.fd, func(fd int) {
+		go f.handleAcceptedFd(fd, l)
+	})
 	if err != nil {
-		f.logger.Error().Err(err).Str("frontend", f.laddr.String()).Msg("can't find next backend")
-		f.logger.Debug().Msgf("closing connection %s -> %s", netConn.RemoteAddr().String(), netConn.LocalAddr().String())
-		netConn.Close()
-		return
+		f.logger.Error().Err(err).Str("frontend", f.laddr.String()).Msg("run()")
 	}
-	// creating a local connection Conn
-	conn := newConn(netConn, f)
-
-	finalizeOnce := sync.Once{}
-	// creating  -->proxy-->  piped connection
-	tunneledConn := newPiped(conn, rConn, &finalizeOnce)
-	tunneledConn.manager.addConn(tunneledConn)
-	// creating  <--proxy<--  piped connection
-	rTunneledConn := newPiped(rConn, conn, &finalizeOnce)
-	rTunneledConn.manager.addConn(rTunneledConn)
 }
 
-// getBuf() returns buffer from the buffer pool.
-func (f *frontend) getBuf() *[]byte {
-	return f.bufPool.Get().(*[]byte)
+// handleAcceptedFd processes the accepted non-blocking fd as a new incoming connection.
+func (f *frontend) handleAcceptedFd(fd int, l *listener) {
+	setNoDelay(fd)
+	f.logger.Debug().Str("frontend", f.laddr.String()).Int("fd", fd).Msg("accepted new connection")
+	f.handleNewConnection(fd, l)
 }
 
-// serveEvent checks the type of event and handles it.
-func (f *frontend) serveEvent(event unix.EpollEvent) {
-	conn := f.getConnByFD(int(event.Fd))
-	if conn == nil {
+// handleNewConnection processes new incoming connections. It tries to find available backend and create remote connection.
+// In reactor mode the remote connection is created with non-blocking connect in the reactor of the connection,
+// so this function doesn't block. In io_uring mode it blocks until the remote connection is established.
+func (f *frontend) handleNewConnection(fd int, l *listener) {
+	// creating a local connection Conn
+	conn, err := newConn(fd, f)
+	if err != nil {
+		f.logger.Info().Err(err).Str("frontend", f.laddr.String()).Msg("newConn()")
 		return
 	}
-
-	if !conn.setUnderIO(true) {
+	if l.ring != nil {
+		// creating a remote connection Conn
+		rConn, err := f.app.createRemoteConnection(conn.RemoteAddr())
+		f.startRelay(conn, rConn, err, l, nil)
 		return
 	}
+	// both legs are served by the same reactor
+	r := l.reactor
+	if r == nil {
+		r = f.reactors.pick(conn.fd)
+	}
+	f.app.connectRemote(r, conn.RemoteAddr(), func(rConn *Conn, err error) {
+		f.startRelay(conn, rConn, err, l, r)
+	})
+}
 
-	if event.Events&(unix.EPOLLHUP|unix.EPOLLRDHUP) != 0 {
-		go conn.finalizeOnce.Do(func() {
-			fmt.Println("front: because of event type nix.EPOLLHUP|unix.EPOLLRDHUP", event.Events)
-			f.logger.Debug().Msgf("closing connection %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
-			f.logger.Debug().Msgf("closing connection %s -> %s", conn.pipeTo.LocalAddr().String(), conn.pipeTo.RemoteAddr().String())
-			conn.finalize()
-		})
+// startRelay creates two PipedConn for every direction of io operation, and registers them in the reactor r or in the ring of the listener.
+// It closes the incoming connection if the remote connection wasn't created or the pair can't be registered.
+func (f *frontend) startRelay(conn *Conn, rConn *Conn, err error, l *listener, r *reactor) {
+	if err != nil {
+		f.logger.Error().Err(err).Str("frontend", f.laddr.String()).Msg("can't find next backend")
+		f.logger.Debug().Msgf("closing connection %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
+		conn.Close()
 		return
 	}
 
-	// TODO use goroutine pool in the future
-	if event.Events&unix.EPOLLIN != 0 {
-		fmt.Println("front: because of event EPOLLIN", event.Events)
-		go f.serveConn(conn)
+	pair := newConnPair()
+	// creating  -->proxy-->  piped connection
+	tunneledConn := newPiped(conn, rConn, pair, f.app.pipes)
+	// creating  <--proxy<--  piped connection
+	rTunneledConn := newPiped(rConn, conn, pair, f.app.pipes)
+	tunneledConn.reverse, rTunneledConn.reverse = rTunneledConn, tunneledConn
+
+	tunneledConn.manager.addConn(tunneledConn)
+	rTunneledConn.manager.addConn(rTunneledConn)
+	if l.ring != nil {
+		l.ring.addPair(tunneledConn, rTunneledConn)
+		return
+	}
+	conn.reactor, rConn.reactor = r, r
+	err = r.addConn(tunneledConn)
+	if err == nil {
+		err = r.addConn(rTunneledConn)
+	}
+	if err != nil {
+		// the first connection can be served already, so the pair is finalized as usual
+		f.logger.Error().Err(err).Str("frontend", f.laddr.String()).Msg("can't register connection")
+		tunneledConn.pair.finalizeOnce.Do(tunneledConn.finalize)
 	}
 }
 
-// serveConn executes IO operation for connections.
+// serveConn executes IO operation for connections. It also continues IO operation of stalled connections.
 func (f *frontend) serveConn(conn *PipedConn) {
-	buf := f.getBuf()
-	defer f.bufPool.Put(buf)
-
-	n, err := io.CopyBuffer(conn.pipeTo, conn, *buf)
-	conn.setUnderIO(false)
+	err := conn.serve(f.bufPool)
+	if err == nil || errors.Is(err, errStalled) {
+		return
+	}
 
-	if err != nil {
+	if !errors.Is(err, io.EOF) && !conn.pair.finalized.Load() {
 		f.logger.Info().Err(err).Msgf("can't copy data %s -> %s", conn.LocalAddr().String(), conn.pipeTo.RemoteAddr().String())
 	}
-	if err != nil || n == 0 {
-		conn.finalizeOnce.Do(func() {
-			f.logger.Debug().Msgf("closing connection %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
-			f.logger.Debug().Msgf("closing connection %s -> %s", conn.pipeTo.LocalAddr().String(), conn.pipeTo.RemoteAddr().String())
-			conn.finalize()
-		})
-		return
-	}
+	conn.pair.finalizeOnce.Do(func() {
+		f.logger.Debug().Msgf("closing connection %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
+		f.logger.Debug().Msgf("closing connection %s -> %s", conn.pipeTo.LocalAddr().String(), conn.pipeTo.RemoteAddr().String())
+		conn.finalize()
+	})
 }
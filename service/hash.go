@@ -0,0 +1,156 @@
+package service
+
+import (
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// hashPointsPerWeight is the number of ring points of the backend per weight unit.
+const hashPointsPerWeight = 160
+
+// hashKey is the part of the client address which is hashed.
+type hashKey int
+
+const (
+	hashByAddr hashKey = iota
+	hashByIP
+)
+
+func parseHashKey(name string) (hashKey, error) {
+	switch name {
+	case "", "addr":
+		return hashByAddr, nil
+	case "ip":
+		return hashByIP, nil
+	default:
+		return 0, errors.Errorf("unknown hash key %q", name)
+	}
+}
+
+// consistentHash maps the client address onto the consistent hash ring of backends.
+// Every backend has points on the ring proportional to its weight, and the client is served by the backend of the next point.
+// The ring is built for all active backends of the app, so it isn't rebuilt when only some of them are available for the client.
+// The ring uses configured weights, so slow-start doesn't rebuild it.
+// When the backend becomes inactive, only its clients are remapped to other backends.
+type consistentHash struct {
+	key hashKey
+	// bnds are all backends of the app.
+	bnds []*backend
+
+	mu sync.RWMutex
+	// ring is built for active backends ringBnds. It is rebuilt when the set of active backends changes.
+	ringBnds []*backend
+	ring     []hashPoint
+}
+
+type hashPoint struct {
+	hash uint64
+	bnd  *backend
+}
+
+// next returns the backend of the next point of the client on the ring. Points of backends which are not in bnds
+// are skipped clockwise, so only clients of these backends are moved.
+func (b *consistentHash) next(bnds []*backend, client net.Addr) *backend {
+	ring := b.getRing()
+	h := hashString(b.clientKey(client))
+	i := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= h
+	})
+	for n := 0; n < len(ring); n++ {
+		point := ring[(i+n)%len(ring)]
+		if containsBackend(bnds, point.bnd) {
+			return point.bnd
+		}
+	}
+	// available backends are not on the ring, if they have become active after it was built
+	return bnds[0]
+}
+
+// clientKey returns the hashed part of the client address.
+func (b *consistentHash) clientKey(client net.Addr) string {
+	if tcpAddr, ok := client.(*net.TCPAddr); ok && b.key == hashByIP {
+		return tcpAddr.IP.String()
+	}
+	return client.String()
+}
+
+// getRing returns the ring of active backends. It rebuilds the ring if the set of active backends has changed.
+func (b *consistentHash) getRing() []hashPoint {
+	b.mu.RLock()
+	if b.ringIsCurrent() {
+		ring := b.ring
+		b.mu.RUnlock()
+		return ring
+	}
+	b.mu.RUnlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.ringIsCurrent() {
+		b.ringBnds = b.ringBnds[:0]
+		for _, bnd := range b.bnds {
+			if onRing(bnd) {
+				b.ringBnds = append(b.ringBnds, bnd)
+			}
+		}
+		b.ring = buildRing(b.ringBnds)
+	}
+	return b.ring
+}
+
+// ringIsCurrent reports if the ring is built for currently active backends. mu must be held by the caller.
+func (b *consistentHash) ringIsCurrent() bool {
+	i := 0
+	for _, bnd := range b.bnds {
+		if !onRing(bnd) {
+			continue
+		}
+		if i >= len(b.ringBnds) || b.ringBnds[i] != bnd {
+			return false
+		}
+		i++
+	}
+	return i == len(b.ringBnds)
+}
+
+// onRing reports if the backend has points on the ring.
+func onRing(bnd *backend) bool {
+	return bnd.active.Load() && bnd.weight > 0
+}
+
+// buildRing places points of every backend on the ring. Points depend only on the backend address,
+// so they don't move when other backends are added or deleted.
+func buildRing(bnds []*backend) []hashPoint {
+	var ring []hashPoint
+	for _, bnd := range bnds {
+		for i := 0; i < bnd.weight*hashPointsPerWeight; i++ {
+			ring = append(ring, hashPoint{
+				hash: hashString(bnd.addr + "#" + strconv.Itoa(i)),
+				bnd:  bnd,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	return ring
+}
+
+// hashString returns FNV-1a hash of s with the final mixing, because FNV-1a spreads similar strings poorly.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+	// splitmix64 finalizer
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// testClients returns n client addresses from different IPs.
+func testClients(n int) []net.Addr {
+	clients := make([]net.Addr, 0, n)
+	for i := 0; i < n; i++ {
+		clients = append(clients, &net.TCPAddr{IP: net.IPv4(192, 168, byte(i>>8), byte(i)), Port: 40000 + i})
+	}
+	return clients
+}
+
+// without returns bnds without the backend i.
+func without(bnds []*backend, i int) []*backend {
+	res := append([]*backend(nil), bnds[:i]...)
+	return append(res, bnds[i+1:]...)
+}
+
+func TestConsistentHashRemap(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		// gone is the index of the backend which becomes unavailable
+		gone int
+		// inactive makes the backend inactive, otherwise it is only not available (excluded or full)
+		inactive bool
+	}{
+		{name: "inactive", weights: []int{1, 1, 1, 1, 1}, gone: 2, inactive: true},
+		{name: "inactive weighted", weights: []int{1, 3, 2}, gone: 1, inactive: true},
+		{name: "full", weights: []int{1, 1, 1, 1, 1}, gone: 0},
+		{name: "excluded weighted", weights: []int{2, 1, 1}, gone: 2},
+	}
+	clients := testClients(2000)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bnds := newTestBackends(t, tt.weights, nil)
+			b := &consistentHash{key: hashByAddr, bnds: bnds}
+			before := make([]*backend, len(clients))
+			for i, client := range clients {
+				before[i] = b.next(bnds, client)
+			}
+			ring := b.getRing()
+
+			available := without(bnds, tt.gone)
+			if tt.inactive {
+				bnds[tt.gone].active.Store(false)
+			}
+			moved := 0
+			for i, client := range clients {
+				got := b.next(available, client)
+				if got == bnds[tt.gone] {
+					t.Fatalf("client %s is mapped to the unavailable backend", client)
+				}
+				if before[i] != bnds[tt.gone] && got != before[i] {
+					t.Fatalf("client %s is moved from the available backend %s to %s", client, before[i].addr, got.addr)
+				}
+				if got != before[i] {
+					moved++
+				}
+			}
+			if moved == 0 {
+				t.Error("no clients are moved")
+			}
+			rebuilt := &b.getRing()[0] != &ring[0]
+			if rebuilt != tt.inactive {
+				t.Errorf("ring rebuilt = %v, want %v", rebuilt, tt.inactive)
+			}
+
+			// clients return to the backend when it is available again
+			bnds[tt.gone].active.Store(true)
+			for i, client := range clients {
+				if got := b.next(bnds, client); got != before[i] {
+					t.Fatalf("client %s is mapped to %s, want %s", client, got.addr, before[i].addr)
+				}
+			}
+		})
+	}
+}
+
+func TestConsistentHashWeights(t *testing.T) {
+	bnds := newTestBackends(t, []int{3, 1}, nil)
+	b := &consistentHash{key: hashByAddr, bnds: bnds}
+	counts := make([]int, len(bnds))
+	for _, client := range testClients(4000) {
+		counts[backendIndex(bnds, b.next(bnds, client))]++
+	}
+	if counts[0] < 2700 || counts[0] > 3300 {
+		t.Errorf("counts = %v, want about [3000 1000]", counts)
+	}
+}
+
+func TestConsistentHashKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     hashKey
+		client  net.Addr
+		wantKey string
+	}{
+		{name: "addr", key: hashByAddr, client: &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 5000}, wantKey: "10.1.2.3:5000"},
+		{name: "ip", key: hashByIP, client: &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 5000}, wantKey: "10.1.2.3"},
+		{name: "ipv6", key: hashByIP, client: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}, wantKey: "2001:db8::1"},
+		{name: "not tcp", key: hashByIP, client: &net.UnixAddr{Name: "/run/client.sock", Net: "unix"}, wantKey: "/run/client.sock"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &consistentHash{key: tt.key}
+			if got := b.clientKey(tt.client); got != tt.wantKey {
+				t.Errorf("clientKey() = %q, want %q", got, tt.wantKey)
+			}
+		})
+	}
+
+	// all ports of the client IP are mapped to the same backend
+	bnds := newTestBackends(t, []int{1, 1, 1, 1}, nil)
+	b := &consistentHash{key: hashByIP, bnds: bnds}
+	want := b.next(bnds, &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 1})
+	for port := 2; port < 100; port++ {
+		if got := b.next(bnds, &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: port}); got != want {
+			t.Fatalf("port %d is mapped to %s, want %s", port, got.addr, want.addr)
+		}
+	}
+}
+
+func TestParseHashKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    hashKey
+		wantErr bool
+	}{
+		{name: "", want: hashByAddr},
+		{name: "addr", want: hashByAddr},
+		{name: "ip", want: hashByIP},
+		{name: "port", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q", tt.name), func(t *testing.T) {
+			got, err := parseHashKey(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHashKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseHashKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// checker checks the protocol of the backend on the connected healthcheck connection.
+// The check has to be finished before the deadline.
+type checker interface {
+	check(ctx context.Context, conn net.Conn, deadline time.Time) error
+}
+
+// healthcheck defines active health checks of the backend.
+type healthcheck struct {
+	interval time.Duration
+	timeout  time.Duration
+	// jitter is the max random delay added to every interval, so checks of many backends are spread in time.
+	jitter time.Duration
+	// rise is the number of consecutive successful checks after which the inactive backend becomes active.
+	rise int
+	// fall is the number of consecutive failed checks after which the active backend becomes inactive.
+	fall int
+	// checker is nil for "tcp" checks, which only connect to the backend.
+	checker checker
+}
+
+// newHealthcheck merges healthcheck configs of the app and the target. Non-zero fields of the target config win.
+func newHealthcheck(app ConfigHealthcheck, target ConfigHealthcheck) (healthcheck, error) {
+	h := healthcheck{
+		interval: 5 * time.Second,
+		timeout:  2 * time.Second,
+		rise:     1,
+		fall:     1,
+	}
+	var err error
+	for _, c := range []ConfigHealthcheck{app, target} {
+		if c.Interval < 0 || c.Timeout < 0 || c.Jitter < 0 || c.Rise < 0 || c.Fall < 0 {
+			return healthcheck{}, errors.Errorf("invalid healthcheck config %+v", c)
+		}
+		if c.Interval > 0 {
+			h.interval = c.Interval
+		}
+		if c.Timeout > 0 {
+			h.timeout = c.Timeout
+		}
+		if c.Jitter > 0 {
+			h.jitter = c.Jitter
+		}
+		if c.Rise > 0 {
+			h.rise = c.Rise
+		}
+		if c.Fall > 0 {
+			h.fall = c.Fall
+		}
+		if c.Type != "" {
+			h.checker, err = newChecker(c)
+			if err != nil {
+				return healthcheck{}, err
+			}
+		}
+	}
+	return h, nil
+}
+
+// newChecker creates the checker of the healthcheck type.
+func newChecker(c ConfigHealthcheck) (checker, error) {
+	switch c.Type {
+	case "tcp":
+		return nil, nil
+	case "http":
+		return newHTTPChecker(c.HTTP)
+	case "script":
+		return newScriptChecker(c.Script)
+	default:
+		return nil, errors.Errorf("unknown healthcheck type %q", c.Type)
+	}
+}
+
+// nextInterval returns the interval before the next check with the random jitter.
+func (h healthcheck) nextInterval() time.Duration {
+	if h.jitter <= 0 {
+		return h.interval
+	}
+	return h.interval + time.Duration(rand.Int63n(int64(h.jitter)))
+}
+
+// runHealthcheck is blocking method. It is responsible for active health checks of the target backend.
+// It exits if backend ctx is done.
+func (b *backend) runHealthcheck() {
+	// The first check is right after start, and it sets the status without rise and fall thresholds
+	b.resolve()
+	b.setActive(b.check() == nil)
+	b.checked.Store(true)
+
+	timer := time.NewTimer(b.healthcheck.nextInterval())
+	defer timer.Stop()
+
+	// infinite loop to check backend availability
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-timer.C:
+			b.resolve()
+			b.reportHealth(b.check() == nil)
+			timer.Reset(b.healthcheck.nextInterval())
+		}
+	}
+}
+
+// check connects to the backend and checks its protocol with the checker. The check fails after timeout.
+// Its connect latency is observed like the latency of real connects.
+func (b *backend) check() error {
+	dialer := net.Dialer{
+		Timeout: b.healthcheck.timeout,
+	}
+	start := time.Now()
+	netConn, err := dialer.DialContext(b.ctx, "tcp", b.addr)
+	b.observeConnect(start, b.healthcheck.timeout, err)
+	if err != nil {
+		return err
+	}
+	defer netConn.Close()
+	if b.healthcheck.checker == nil {
+		return nil
+	}
+	err = b.healthcheck.checker.check(b.ctx, netConn, start.Add(b.healthcheck.timeout))
+	if err != nil {
+		b.logger.Debug().Err(err).Str("backend", b.addr).Msg("healthcheck failed")
+	}
+	return err
+}
+
+// reportConnect counts the connect of the client as the passive check. The successful connect doesn't prove
+// that the backend serves its protocol, so only failed connects are counted if the backend has the checker.
+func (b *backend) reportConnect(err error) {
+	if err == nil && b.healthcheck.checker != nil {
+		return
+	}
+	b.reportHealth(err == nil)
+}
+
+// reportHealth counts consecutive results of active and passive checks.
+// The inactive backend becomes active after rise successes, and the active backend becomes inactive after fall failures.
+func (b *backend) reportHealth(ok bool) {
+	b.hmu.Lock()
+	if ok {
+		b.successes++
+		b.fails = 0
+	} else {
+		b.fails++
+		b.successes = 0
+	}
+	active := b.active.Load()
+	change := (ok && !active && b.successes >= b.healthcheck.rise) || (!ok && active && b.fails >= b.healthcheck.fall)
+	b.hmu.Unlock()
+
+	if change {
+		b.setActive(ok)
+	}
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// httpCheckBodyLimit is the max size of the response body which is matched with the regex.
+const httpCheckBodyLimit = 64 * 1024
+
+// httpChecker sends the HTTP request and checks the response status and body.
+type httpChecker struct {
+	method  string
+	path    string
+	headers map[string]string
+	// minStatus and maxStatus are the expected range of the response status.
+	minStatus int
+	maxStatus int
+	// body is nil if the response body isn't checked.
+	body *regexp.Regexp
+}
+
+func newHTTPChecker(c ConfigHTTPCheck) (*httpChecker, error) {
+	h := &httpChecker{
+		method:  c.Method,
+		path:    c.Path,
+		headers: c.Headers,
+	}
+	if h.method == "" {
+		h.method = http.MethodGet
+	}
+	if h.path == "" {
+		h.path = "/"
+	}
+	if !strings.HasPrefix(h.path, "/") {
+		return nil, errors.Errorf("invalid healthcheck path %q", h.path)
+	}
+
+	var err error
+	h.minStatus, h.maxStatus, err = parseStatusRange(c.ExpectStatus)
+	if err != nil {
+		return nil, err
+	}
+	if c.ExpectBody != "" {
+		h.body, err = regexp.Compile(c.ExpectBody)
+		if err != nil {
+			return nil, errors.Wrap(err, "Compile() expected body")
+		}
+	}
+	return h, nil
+}
+
+// parseStatusRange parses the status range like "200-399" or the single status like "204". Empty range means "200-399".
+func parseStatusRange(s string) (int, int, error) {
+	if s == "" {
+		return 200, 399, nil
+	}
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		to = from
+	}
+	minStatus, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid expected status %q", s)
+	}
+	maxStatus, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid expected status %q", s)
+	}
+	if minStatus < 100 || maxStatus > 599 || minStatus > maxStatus {
+		return 0, 0, errors.Errorf("invalid expected status %q", s)
+	}
+	return minStatus, maxStatus, nil
+}
+
+func (h *httpChecker) check(ctx context.Context, conn net.Conn, deadline time.Time) error {
+	err := conn.SetDeadline(deadline)
+	if err != nil {
+		return errors.Wrap(err, "SetDeadline()")
+	}
+	req, err := http.NewRequestWithContext(ctx, h.method, "http://"+conn.RemoteAddr().String()+h.path, nil)
+	if err != nil {
+		return errors.Wrap(err, "NewRequest()")
+	}
+	for name, value := range h.headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+	req.Close = true
+	err = req.Write(conn)
+	if err != nil {
+		return errors.Wrap(err, "Write() request")
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return errors.Wrap(err, "ReadResponse()")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < h.minStatus || resp.StatusCode > h.maxStatus {
+		return errors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if h.body == nil {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, httpCheckBodyLimit))
+	if err != nil {
+		return errors.Wrap(err, "ReadAll() body")
+	}
+	if !h.body.Match(body) {
+		return errors.New("unexpected body")
+	}
+	return nil
+}
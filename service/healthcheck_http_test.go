@@ -0,0 +1,182 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestParseStatusRange(t *testing.T) {
+	tests := []struct {
+		s       string
+		wantMin int
+		wantMax int
+		wantErr bool
+	}{
+		{s: "", wantMin: 200, wantMax: 399},
+		{s: "204", wantMin: 204, wantMax: 204},
+		{s: "200-299", wantMin: 200, wantMax: 299},
+		{s: " 200 - 499 ", wantMin: 200, wantMax: 499},
+		{s: "100-599", wantMin: 100, wantMax: 599},
+		{s: "99", wantErr: true},
+		{s: "200-600", wantErr: true},
+		{s: "300-200", wantErr: true},
+		{s: "2xx", wantErr: true},
+		{s: "200-", wantErr: true},
+		{s: "-299", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q", tt.s), func(t *testing.T) {
+			gotMin, gotMax, err := parseStatusRange(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseStatusRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if gotMin != tt.wantMin || gotMax != tt.wantMax {
+				t.Errorf("parseStatusRange() = %d-%d, want %d-%d", gotMin, gotMax, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestNewHTTPChecker(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ConfigHTTPCheck
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "full", config: ConfigHTTPCheck{Method: http.MethodHead, Path: "/health", ExpectStatus: "200-299", ExpectBody: "^ok$"}},
+		{name: "relative path", config: ConfigHTTPCheck{Path: "health"}, wantErr: true},
+		{name: "invalid status", config: ConfigHTTPCheck{ExpectStatus: "600"}, wantErr: true},
+		{name: "invalid body regex", config: ConfigHTTPCheck{ExpectBody: "("}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newHTTPChecker(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newHTTPChecker() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPCheckerCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ConfigHTTPCheck
+		status  int
+		body    string
+		wantErr bool
+	}{
+		{name: "ok", status: http.StatusOK},
+		{name: "redirect is ok by default", status: http.StatusFound},
+		{name: "server error", status: http.StatusServiceUnavailable, wantErr: true},
+		{name: "unexpected status", config: ConfigHTTPCheck{ExpectStatus: "204"}, status: http.StatusOK, wantErr: true},
+		{name: "body matches", config: ConfigHTTPCheck{ExpectBody: `"status":\s*"up"`}, status: http.StatusOK, body: `{"status": "up"}`},
+		{name: "body doesn't match", config: ConfigHTTPCheck{ExpectBody: `"status":\s*"up"`}, status: http.StatusOK, body: `{"status": "down"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Path = "/health"
+			tt.config.Headers = map[string]string{"Host": "example.com", "X-Check": "1"}
+			h, err := newHTTPChecker(tt.config)
+			if err != nil {
+				t.Fatalf("newHTTPChecker(): %v", err)
+			}
+			client, server := net.Pipe()
+			status, body := tt.status, tt.body
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				defer server.Close()
+				req, err := http.ReadRequest(bufio.NewReader(server))
+				if err != nil {
+					t.Errorf("ReadRequest(): %v", err)
+					return
+				}
+				if req.Method != http.MethodGet || req.URL.Path != "/health" || req.Host != "example.com" || req.Header.Get("X-Check") != "1" {
+					t.Errorf("unexpected request %s %s, host %q, headers %v", req.Method, req.URL, req.Host, req.Header)
+				}
+				fmt.Fprintf(server, "HTTP/1.1 %d %s\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+					status, http.StatusText(status), len(body), body)
+			}()
+			err = h.check(context.Background(), client, time.Now().Add(5*time.Second))
+			client.Close()
+			<-done
+			if (err != nil) != tt.wantErr {
+				t.Errorf("check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// serveHTTPStatus serves HTTP requests with the status until the test ends. It returns the server address.
+func serveHTTPStatus(t *testing.T, status int) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestHTTPCheckFailsBackendUnderTraffic(t *testing.T) {
+	checker, err := newHTTPChecker(ConfigHTTPCheck{})
+	if err != nil {
+		t.Fatalf("newHTTPChecker(): %v", err)
+	}
+	addr := serveHTTPStatus(t, http.StatusServiceUnavailable)
+	logger := zerolog.Nop()
+	bnd, err := newBackend(context.Background(), &logger, addr, backendConfig{
+		weight:      1,
+		healthcheck: healthcheck{timeout: time.Second, rise: 1, fall: 3, checker: checker},
+	}, nil)
+	if err != nil {
+		t.Fatalf("newBackend(): %v", err)
+	}
+	bnd.active.Store(true)
+
+	// clients connect to the backend between checks, the backend accepts their connections
+	for i := 0; i < 3; i++ {
+		if err := bnd.check(); err == nil {
+			t.Fatal("check() of the failing backend passed")
+		}
+		bnd.reportHealth(false)
+		for j := 0; j < 5; j++ {
+			bnd.reserve()
+			conn, err := bnd.createConn(time.Second)
+			if err != nil {
+				t.Fatalf("createConn(): %v", err)
+			}
+			conn.Close()
+			bnd.release()
+		}
+	}
+	if bnd.active.Load() {
+		t.Error("backend failing http check is active")
+	}
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// scriptCheckReadLimit is the max size of the data which is read by one expect step.
+const scriptCheckReadLimit = 64 * 1024
+
+// scriptChecker runs send/expect steps on the healthcheck connection.
+type scriptChecker struct {
+	steps []scriptStep
+}
+
+// scriptStep sends data, and after that it expects the literal data or the data matching regex.
+type scriptStep struct {
+	send   []byte
+	expect []byte
+	// regex is nil if the step expects the literal data.
+	regex *regexp.Regexp
+	// timeout is 0 if the step is limited only by the healthcheck timeout.
+	timeout time.Duration
+}
+
+func newScriptChecker(steps []ConfigCheckStep) (*scriptChecker, error) {
+	if len(steps) == 0 {
+		return nil, errors.New("healthcheck script has no steps")
+	}
+	s := &scriptChecker{}
+	for i, c := range steps {
+		if c.Timeout < 0 || (c.Expect != "" && c.ExpectRegex != "") || (c.Send == "" && c.Expect == "" && c.ExpectRegex == "") {
+			return nil, errors.Errorf("invalid healthcheck script step %d %+v", i, c)
+		}
+		step := scriptStep{
+			send:    []byte(c.Send),
+			expect:  []byte(c.Expect),
+			timeout: c.Timeout,
+		}
+		if c.ExpectRegex != "" {
+			regex, err := regexp.Compile(c.ExpectRegex)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Compile() regex of step %d", i)
+			}
+			step.regex = regex
+		}
+		s.steps = append(s.steps, step)
+	}
+	return s, nil
+}
+
+func (s *scriptChecker) check(ctx context.Context, conn net.Conn, deadline time.Time) error {
+	// received is the data which is read, but not yet consumed by expect steps
+	var received []byte
+	buf := make([]byte, 4096)
+	for i, step := range s.steps {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		stepDeadline := deadline
+		if step.timeout > 0 && time.Now().Add(step.timeout).Before(deadline) {
+			stepDeadline = time.Now().Add(step.timeout)
+		}
+		err := conn.SetDeadline(stepDeadline)
+		if err != nil {
+			return errors.Wrap(err, "SetDeadline()")
+		}
+
+		if len(step.send) > 0 {
+			_, err = conn.Write(step.send)
+			if err != nil {
+				return errors.Wrapf(err, "Write() of step %d", i)
+			}
+		}
+		if len(step.expect) == 0 && step.regex == nil {
+			continue
+		}
+
+		// the data is read until it matches, so the regex is matched with the data received so far
+		for {
+			n, ok := step.match(received)
+			if ok {
+				received = received[n:]
+				break
+			}
+			if n < 0 || len(received) >= scriptCheckReadLimit {
+				return errors.Errorf("unexpected data %q at step %d", received, i)
+			}
+			read, err := conn.Read(buf)
+			received = append(received, buf[:read]...)
+			if err != nil && read == 0 {
+				return errors.Wrapf(err, "Read() of step %d, received %q", i, received)
+			}
+		}
+	}
+	return nil
+}
+
+// match checks the received data. It returns the length of the matched data if it matches,
+// or -1 if the received data can't match anymore.
+func (s scriptStep) match(received []byte) (int, bool) {
+	if s.regex != nil {
+		loc := s.regex.FindIndex(received)
+		if loc == nil {
+			return 0, false
+		}
+		return loc[1], true
+	}
+	if len(received) < len(s.expect) {
+		if !bytes.HasPrefix(s.expect, received) {
+			return -1, false
+		}
+		return 0, false
+	}
+	if !bytes.HasPrefix(received, s.expect) {
+		return -1, false
+	}
+	return len(s.expect), true
+}
@@ -0,0 +1,211 @@
+package service
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestScriptStepMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		step     scriptStep
+		received string
+		wantN    int
+		wantOK   bool
+	}{
+		{name: "literal", step: scriptStep{expect: []byte("+PONG\r\n")}, received: "+PONG\r\n", wantN: 7, wantOK: true},
+		{name: "literal with more data", step: scriptStep{expect: []byte("+OK")}, received: "+OK\r\n+PONG", wantN: 3, wantOK: true},
+		{name: "literal prefix", step: scriptStep{expect: []byte("+PONG\r\n")}, received: "+PO", wantN: 0},
+		{name: "nothing received", step: scriptStep{expect: []byte("+PONG")}, received: "", wantN: 0},
+		{name: "literal mismatch", step: scriptStep{expect: []byte("+PONG")}, received: "-ERR", wantN: -1},
+		{name: "literal early mismatch", step: scriptStep{expect: []byte("+PONG")}, received: "-E", wantN: -1},
+		{name: "regex", step: scriptStep{regex: regexp.MustCompile(`^220 .*\r\n`)}, received: "220 mail ESMTP\r\n250 next", wantN: 16, wantOK: true},
+		{name: "regex in the middle", step: scriptStep{regex: regexp.MustCompile(`role:master`)}, received: "# Replication\r\nrole:master\r\n", wantN: 26, wantOK: true},
+		{name: "regex not yet", step: scriptStep{regex: regexp.MustCompile(`^220 .*\r\n`)}, received: "220 mail", wantN: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, ok := tt.step.match([]byte(tt.received))
+			if n != tt.wantN || ok != tt.wantOK {
+				t.Errorf("match() = %d, %v, want %d, %v", n, ok, tt.wantN, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestNewScriptChecker(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   []ConfigCheckStep
+		wantErr bool
+	}{
+		{name: "send and expect", steps: []ConfigCheckStep{{Send: "PING\r\n", Expect: "+PONG\r\n"}}},
+		{name: "expect regex", steps: []ConfigCheckStep{{ExpectRegex: `^220 `, Timeout: time.Second}, {Send: "QUIT\r\n"}}},
+		{name: "no steps", wantErr: true},
+		{name: "empty step", steps: []ConfigCheckStep{{}}, wantErr: true},
+		{name: "both expects", steps: []ConfigCheckStep{{Expect: "+OK", ExpectRegex: `^\+OK`}}, wantErr: true},
+		{name: "negative timeout", steps: []ConfigCheckStep{{Send: "PING\r\n", Timeout: -time.Second}}, wantErr: true},
+		{name: "invalid regex", steps: []ConfigCheckStep{{ExpectRegex: "("}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newScriptChecker(tt.steps)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newScriptChecker() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScriptCheckerCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []ConfigCheckStep
+		// replies are written by the backend in separate writes after it reads the first send
+		replies []string
+		wantErr bool
+	}{
+		{
+			name:    "redis ping",
+			steps:   []ConfigCheckStep{{Send: "PING\r\n", Expect: "+PONG\r\n"}},
+			replies: []string{"+PONG\r\n"},
+		},
+		{
+			name:    "split reply",
+			steps:   []ConfigCheckStep{{Send: "PING\r\n", Expect: "+PONG\r\n"}},
+			replies: []string{"+PO", "NG\r\n"},
+		},
+		{
+			name:    "two expects in one reply",
+			steps:   []ConfigCheckStep{{Send: "AUTH x\r\n", Expect: "+OK\r\n"}, {ExpectRegex: `^\+PONG\r\n`}},
+			replies: []string{"+OK\r\n+PONG\r\n"},
+		},
+		{
+			name:    "wrong reply",
+			steps:   []ConfigCheckStep{{Send: "PING\r\n", Expect: "+PONG\r\n"}},
+			replies: []string{"-NOAUTH Authentication required\r\n"},
+			wantErr: true,
+		},
+		{
+			name:    "closed before reply",
+			steps:   []ConfigCheckStep{{Send: "PING\r\n", Expect: "+PONG\r\n"}},
+			replies: []string{"+PO"},
+			wantErr: true,
+		},
+		{
+			name:    "step timeout",
+			steps:   []ConfigCheckStep{{Send: "PING\r\n", Expect: "+PONG\r\n", Timeout: 50 * time.Millisecond}},
+			replies: nil,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newScriptChecker(tt.steps)
+			if err != nil {
+				t.Fatalf("newScriptChecker(): %v", err)
+			}
+			client, server := net.Pipe()
+			defer server.Close()
+			replies := tt.replies
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				buf := make([]byte, 100)
+				if _, err := server.Read(buf); err != nil {
+					return
+				}
+				for _, reply := range replies {
+					if _, err := server.Write([]byte(reply)); err != nil {
+						return
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				if replies != nil {
+					server.Close()
+				}
+			}()
+			err = s.check(context.Background(), client, time.Now().Add(5*time.Second))
+			client.Close()
+			<-done
+			if (err != nil) != tt.wantErr {
+				t.Errorf("check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// serveReply replies to every read of the connection with reply until the test ends. It returns the server address.
+func serveReply(t *testing.T, reply string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 100)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestScriptCheckFailsBackendUnderTraffic(t *testing.T) {
+	checker, err := newScriptChecker([]ConfigCheckStep{{Send: "PING\r\n", Expect: "+PONG\r\n"}})
+	if err != nil {
+		t.Fatalf("newScriptChecker(): %v", err)
+	}
+	addr := serveReply(t, "-LOADING Redis is loading the dataset in memory\r\n")
+	logger := zerolog.Nop()
+	bnd, err := newBackend(context.Background(), &logger, addr, backendConfig{
+		weight:      1,
+		healthcheck: healthcheck{timeout: time.Second, rise: 1, fall: 3, checker: checker},
+	}, nil)
+	if err != nil {
+		t.Fatalf("newBackend(): %v", err)
+	}
+	bnd.active.Store(true)
+
+	// clients connect to the backend between checks, the backend accepts their connections
+	for i := 0; i < 3; i++ {
+		if err := bnd.check(); err == nil {
+			t.Fatal("check() of the loading backend passed")
+		}
+		bnd.reportHealth(false)
+		for j := 0; j < 5; j++ {
+			bnd.reserve()
+			conn, err := bnd.createConn(time.Second)
+			if err != nil {
+				t.Fatalf("createConn(): %v", err)
+			}
+			conn.Close()
+			bnd.release()
+		}
+	}
+	if bnd.active.Load() {
+		t.Error("backend failing script check is active")
+	}
+}
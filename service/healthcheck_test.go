@@ -0,0 +1,76 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+func TestReportHealth(t *testing.T) {
+	// results are "s" and "f" for active checks, "c" and "e" for successful and failed connects of clients.
+	// active is the expected state after every result
+	tests := []struct {
+		name    string
+		active  bool
+		checker bool
+		rise    int
+		fall    int
+		results string
+		want    string
+	}{
+		{name: "rise", rise: 2, fall: 3, results: "sss", want: "011"},
+		{name: "rise at once", rise: 1, fall: 3, results: "s", want: "1"},
+		{name: "fall", active: true, rise: 2, fall: 3, results: "fff", want: "110"},
+		{name: "fall at once", active: true, rise: 2, fall: 1, results: "f", want: "0"},
+		{name: "fail resets rise", rise: 3, fall: 3, results: "ssfsss", want: "000001"},
+		{name: "success resets fall", active: true, rise: 3, fall: 3, results: "ffsfff", want: "111110"},
+		{name: "alternating doesn't rise", rise: 2, fall: 2, results: "sfsfsf", want: "000000"},
+		{name: "alternating doesn't fall", active: true, rise: 2, fall: 2, results: "fsfsfs", want: "111111"},
+		{name: "fall and rise again", active: true, rise: 2, fall: 2, results: "ffss", want: "1001"},
+		{name: "connects without checker rise", rise: 2, fall: 3, results: "sc", want: "01"},
+		{name: "connects without checker reset fall", active: true, rise: 2, fall: 3, results: "ffcff", want: "11111"},
+		{name: "failed connects fall", active: true, rise: 2, fall: 3, results: "fee", want: "110"},
+		{name: "failed connects with checker fall", active: true, checker: true, rise: 2, fall: 3, results: "fee", want: "110"},
+		{name: "connects with checker don't reset fall", active: true, checker: true, rise: 2, fall: 3, results: "fcfcf", want: "11110"},
+		{name: "connects with checker don't rise", checker: true, rise: 1, fall: 3, results: "ccs", want: "001"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := zerolog.Nop()
+			h := healthcheck{rise: tt.rise, fall: tt.fall}
+			if tt.checker {
+				h.checker = &httpChecker{}
+			}
+			bnd, err := newBackend(context.Background(), &logger, "10.0.0.1:80", backendConfig{weight: 1, healthcheck: h}, nil)
+			if err != nil {
+				t.Fatalf("newBackend(): %v", err)
+			}
+			bnd.active.Store(tt.active)
+
+			var got strings.Builder
+			for _, result := range tt.results {
+				switch result {
+				case 's':
+					bnd.reportHealth(true)
+				case 'f':
+					bnd.reportHealth(false)
+				case 'c':
+					bnd.reportConnect(nil)
+				case 'e':
+					bnd.reportConnect(errors.New("connection refused"))
+				}
+				if bnd.active.Load() {
+					got.WriteByte('1')
+				} else {
+					got.WriteByte('0')
+				}
+			}
+			if got.String() != tt.want {
+				t.Errorf("active = %s, want %s", got.String(), tt.want)
+			}
+		})
+	}
+}
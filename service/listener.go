@@ -0,0 +1,89 @@
+package service
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// listener is one of frontend listeners with its own accept loop.
+type listener struct {
+	// fd is the raw non-blocking listening socket.
+	fd int
+	// reactor serves connections accepted by the listener. It is nil if connections are assigned by the reactor pool.
+	reactor *reactor
+	// ring is used instead of reactor in io_uring mode.
+	ring *uringRelay
+}
+
+// listenSocket creates raw non-blocking listening socket. With reusePort the socket is created with SO_REUSEPORT,
+// so several sockets can be bound to the same address, and the kernel spreads new connections across them.
+// The address without IP is listened on all IPv4 and IPv6 addresses if the system supports it.
+func listenSocket(addr *net.TCPAddr, reusePort bool) (int, error) {
+	fd, err := listenSocketIP(addr, reusePort)
+	if err != nil && addr.IP == nil {
+		// dual-stack socket isn't supported, so all IPv4 addresses are listened
+		fd, err = listenSocketIP(&net.TCPAddr{IP: net.IPv4zero, Port: addr.Port}, reusePort)
+	}
+	return fd, err
+}
+
+func listenSocketIP(addr *net.TCPAddr, reusePort bool) (int, error) {
+	var sa unix.Sockaddr
+	var domain int
+	dualStack := addr.IP == nil
+	if dualStack {
+		sa, domain = &unix.SockaddrInet6{Port: addr.Port}, unix.AF_INET6
+	} else {
+		var err error
+		if sa, domain, err = sockaddr(addr); err != nil {
+			return -1, err
+		}
+	}
+
+	fd, err := unix.Socket(domain, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return -1, errors.Wrap(err, "Socket()")
+	}
+	unix.CloseOnExec(fd)
+	err = setListenOptions(fd, dualStack, reusePort)
+	if err == nil {
+		err = unix.Bind(fd, sa)
+		if err != nil {
+			err = errors.Wrap(err, "Bind()")
+		}
+	}
+	if err == nil {
+		err = unix.Listen(fd, unix.SOMAXCONN)
+		if err != nil {
+			err = errors.Wrap(err, "Listen()")
+		}
+	}
+	if err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// setListenOptions sets options of the listening socket like Go runtime does, and SO_REUSEPORT if it is needed.
+func setListenOptions(fd int, dualStack bool, reusePort bool) error {
+	if err := unix.SetNonblock(fd, true); err != nil {
+		return errors.Wrap(err, "SetNonblock()")
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		return errors.Wrap(err, "SO_REUSEADDR")
+	}
+	if dualStack {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 0); err != nil {
+			return errors.Wrap(err, "IPV6_V6ONLY")
+		}
+	}
+	if reusePort {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return errors.Wrap(err, "SO_REUSEPORT")
+		}
+	}
+	return nil
+}
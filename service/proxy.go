@@ -2,24 +2,51 @@ package service
 
 import (
 	"context"
+	"runtime"
 	"sync"
+	"time"
 
+	"github.com/hotafrika/tcp_proxy_epoll/pkg/dispatcher"
+	"github.com/hotafrika/tcp_proxy_epoll/pkg/epoll"
+	"github.com/hotafrika/tcp_proxy_epoll/pkg/poller"
+	"github.com/hotafrika/tcp_proxy_epoll/pkg/portable"
+	"github.com/hotafrika/tcp_proxy_epoll/pkg/uring"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 )
 
 type Proxy struct {
-	ctx     context.Context
-	cancel  context.CancelFunc
-	logger  *zerolog.Logger
-	apps    []*application
-	fnds    []*frontend
-	bnds    []*backend
-	bufPool *sync.Pool
+	ctx        context.Context
+	cancel     context.CancelFunc
+	logger     *zerolog.Logger
+	apps       []*application
+	fnds       []*frontend
+	bnds       []*backend
+	bufPool    *sync.Pool
+	dispatcher *dispatcher.Dispatcher
+	reactors   *reactorPool
+	pipes      *pipePool
+	failure    *failure
+}
+
+// failure keeps the first error which stopped the proxy.
+type failure struct {
+	once   sync.Once
+	err    error
+	cancel context.CancelFunc
+}
+
+// fail stops the proxy with err. Only the first error is kept.
+func (f *failure) fail(err error) {
+	f.once.Do(func() {
+		f.err = err
+		f.cancel()
+	})
 }
 
 func NewProxy(ctx context.Context, logger *zerolog.Logger, config ProxyConfig) (Proxy, error) {
 	nCtx, cancel := context.WithCancel(ctx)
+	fail := &failure{cancel: cancel}
 
 	bufPool := sync.Pool{
 		New: func() any {
@@ -32,11 +59,136 @@ func NewProxy(ctx context.Context, logger *zerolog.Logger, config ProxyConfig) (
 	fnds := make([]*frontend, 0, len(config.Apps))
 	bnds := make([]*backend, 0, len(config.Apps))
 
+	pollerKind := config.Poller
+	if pollerKind == "io_uring" {
+		if err := uring.Probe(); err != nil {
+			logger.Warn().Err(err).Msg("io_uring is not supported, epoll is used")
+			pollerKind = "epoll"
+		}
+	}
+	// in io_uring mode frontends have rings instead of pollers
+	var newPoller func() (poller.Poller, error)
+	var newRing func() (*uringRelay, error)
+	if pollerKind == "io_uring" {
+		newRing = func() (*uringRelay, error) {
+			return newUringRelay(nCtx, logger)
+		}
+	} else {
+		var err error
+		newPoller, err = pollerFactory(pollerKind, config.EdgeTriggered)
+		if err != nil {
+			cancel()
+			return Proxy{}, errors.Wrap(err, "pollerFactory()")
+		}
+	}
+
+	overflow, err := dispatcher.ParseOverflow(config.Dispatcher.Overflow)
+	if err != nil {
+		cancel()
+		return Proxy{}, errors.Wrap(err, "ParseOverflow()")
+	}
+	workers := config.Dispatcher.Workers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	queueSize := config.Dispatcher.QueueSize
+	if queueSize == 0 {
+		queueSize = 1024
+	}
+	dsp, err := dispatcher.New(nCtx, workers, queueSize, overflow)
+	if err != nil {
+		cancel()
+		return Proxy{}, errors.Wrap(err, "dispatcher.New()")
+	}
+
+	// pipes are shared by all apps with splice relay mode
+	var pipes *pipePool
+
+	// in io_uring mode frontends serve their connections with rings, so there are no reactors
+	var reactors *reactorPool
+	if newPoller != nil {
+		assign, err := parseAssignPolicy(config.Reactors.Assign)
+		if err != nil {
+			cancel()
+			return Proxy{}, errors.Wrap(err, "parseAssignPolicy()")
+		}
+		count := config.Reactors.Count
+		if count == 0 {
+			count = runtime.GOMAXPROCS(0)
+		}
+		reactors, err = newReactorPool(nCtx, logger, count, assign, newPoller, dsp, fail.fail)
+		if err != nil {
+			cancel()
+			return Proxy{}, errors.Wrap(err, "newReactorPool()")
+		}
+	}
+
 	for _, configApp := range config.Apps {
+		var appPipes *pipePool
+		switch configApp.Relay {
+		case "", "copy":
+		case "splice":
+			if newRing != nil {
+				logger.Warn().Str("app", configApp.Name).Msg("splice relay is not used in io_uring mode")
+				break
+			}
+			if pipes == nil {
+				pipes, err = newPipePool(1024)
+				if err != nil {
+					cancel()
+					return Proxy{}, errors.Wrap(err, "newPipePool()")
+				}
+			}
+			appPipes = pipes
+		default:
+			cancel()
+			return Proxy{}, errors.Errorf("unknown relay %q of app %q", configApp.Relay, configApp.Name)
+		}
+
+		var sticky *stickyTable
+		if configApp.Sticky.TTL > 0 {
+			maxSize := configApp.Sticky.MaxSize
+			if maxSize == 0 {
+				maxSize = 65536
+			}
+			sticky = newStickyTable(configApp.Sticky.TTL, maxSize)
+		}
+
+		retry := retryPolicy{
+			attempts:     configApp.Retry.Attempts,
+			excludeTried: configApp.Retry.ExcludeTried,
+			backoff:      configApp.Retry.Backoff,
+			deadline:     configApp.Retry.Deadline,
+		}
+		if retry.attempts < 0 {
+			cancel()
+			return Proxy{}, errors.Errorf("invalid retry attempts %d of app %q", retry.attempts, configApp.Name)
+		}
+		if retry.attempts == 0 {
+			retry.attempts = 1
+		}
+
 		// Create backends for the app
 		appBnds := make([]*backend, 0, len(configApp.Targets))
+		connectTimeout := configApp.ConnectTimeout
+		if connectTimeout == 0 {
+			connectTimeout = 2 * time.Second
+		}
 		for _, target := range configApp.Targets {
-			bnd, err := newBackend(ctx, logger, target, &bufPool)
+			hc, err := newHealthcheck(configApp.Healthcheck, target.Healthcheck)
+			if err != nil {
+				cancel()
+				return Proxy{}, errors.Wrapf(err, "newHealthcheck() of backend %q", target.Address)
+			}
+			bndConfig := backendConfig{
+				weight:         target.Weight,
+				priority:       target.Priority,
+				maxConns:       target.MaxConnections,
+				slowStart:      configApp.SlowStart,
+				connectTimeout: connectTimeout,
+				healthcheck:    hc,
+			}
+			bnd, err := newBackend(nCtx, logger, target.Address, bndConfig, &bufPool)
 			if err != nil {
 				cancel()
 				return Proxy{}, errors.Wrap(err, "newBackend()")
@@ -45,13 +197,31 @@ func NewProxy(ctx context.Context, logger *zerolog.Logger, config ProxyConfig) (
 		}
 		bnds = append(bnds, appBnds...)
 
+		blr, err := newBalancer(configApp.Balancer, configApp.HashBy, appBnds)
+		if err != nil {
+			cancel()
+			return Proxy{}, errors.Wrapf(err, "newBalancer() of app %q", configApp.Name)
+		}
+
 		// Create app
-		app := newApplication(nCtx, logger, configApp.Name, appBnds)
+		minHealthy := configApp.MinHealthy
+		if minHealthy == 0 {
+			minHealthy = 1
+		}
+		var queue *clientQueue
+		if configApp.Queue.Size > 0 {
+			timeout := configApp.Queue.Timeout
+			if timeout == 0 {
+				timeout = 5 * time.Second
+			}
+			queue = newClientQueue(configApp.Queue.Size, timeout)
+		}
+		app := newApplication(nCtx, logger, configApp.Name, appBnds, minHealthy, blr, sticky, retry, queue, appPipes)
 		apps = append(apps, app)
 
 		// Create frontends for the app
 		for _, port := range configApp.Ports {
-			fnd, err := newFrontend(nCtx, logger, port, app, &bufPool)
+			fnd, err := newFrontend(nCtx, logger, port, app, &bufPool, reactors, newRing, configApp.Listeners)
 			if err != nil {
 				cancel()
 				return Proxy{}, errors.Wrap(err, "newFrontend()")
@@ -61,20 +231,28 @@ func NewProxy(ctx context.Context, logger *zerolog.Logger, config ProxyConfig) (
 	}
 
 	return Proxy{
-		ctx:     nCtx,
-		cancel:  cancel,
-		logger:  logger,
-		apps:    apps,
-		fnds:    fnds,
-		bnds:    bnds,
-		bufPool: &bufPool,
+		ctx:        nCtx,
+		cancel:     cancel,
+		logger:     logger,
+		apps:       apps,
+		fnds:       fnds,
+		bnds:       bnds,
+		bufPool:    &bufPool,
+		dispatcher: dsp,
+		reactors:   reactors,
+		pipes:      pipes,
+		failure:    fail,
 	}, nil
 }
 
 // Run blocks until all frontends and backends finish work (ctx is done).
-func (p Proxy) Run() {
+// It returns the error if the proxy was stopped by the failure.
+func (p Proxy) Run() error {
 	var wg sync.WaitGroup
 
+	if p.reactors != nil {
+		p.reactors.run(&wg)
+	}
 	for _, bnd := range p.bnds {
 		bnd := bnd
 		wg.Add(1)
@@ -83,19 +261,226 @@ func (p Proxy) Run() {
 	for _, fnd := range p.fnds {
 		fnd := fnd
 		wg.Add(1)
-		go fnd.run(&wg)
+		go func() {
+			defer wg.Done()
+			if err := fnd.run(); err != nil {
+				p.failure.fail(err)
+			}
+		}()
 	}
 
 	wg.Wait()
+	if p.pipes != nil {
+		p.pipes.close()
+	}
+	return p.failure.err
+}
+
+// pollerFactory returns the function which creates pollers of the kind.
+func pollerFactory(kind string, edgeTriggered bool) (func() (poller.Poller, error), error) {
+	if kind == "" {
+		kind = "portable"
+		if runtime.GOOS == "linux" {
+			kind = "epoll"
+		}
+	}
+	switch kind {
+	case "epoll":
+		mode := epoll.LevelTriggered
+		if edgeTriggered {
+			mode = epoll.EdgeTriggered
+		}
+		return func() (poller.Poller, error) {
+			return epoll.New(mode)
+		}, nil
+	case "portable":
+		return func() (poller.Poller, error) {
+			return portable.New(), nil
+		}, nil
+	default:
+		return nil, errors.Errorf("unknown poller %q", kind)
+	}
+}
+
+// ReactorLoads returns the number of connections of every reactor.
+func (p Proxy) ReactorLoads() []int64 {
+	if p.reactors == nil {
+		return nil
+	}
+	return p.reactors.loads()
+}
+
+// BackendStats returns states of backends of all apps.
+func (p Proxy) BackendStats() []BackendStats {
+	var stats []BackendStats
+	for _, app := range p.apps {
+		for _, bnd := range app.bnds {
+			stats = append(stats, bnd.stats(app.name))
+		}
+	}
+	return stats
+}
+
+// StickyEntries returns entries of sticky tables by app names. Apps without sticky tables are omitted.
+func (p Proxy) StickyEntries() map[string][]StickyEntry {
+	entries := make(map[string][]StickyEntry)
+	now := time.Now()
+	for _, app := range p.apps {
+		if app.sticky != nil {
+			entries[app.name] = app.sticky.list(now)
+		}
+	}
+	return entries
+}
+
+// ClearSticky removes the entry of the client IP from the sticky table of the app, or all entries if client is empty.
+// It returns the number of removed entries.
+func (p Proxy) ClearSticky(appName string, client string) (int, error) {
+	for _, app := range p.apps {
+		if app.name != appName {
+			continue
+		}
+		if app.sticky == nil {
+			return 0, errors.Errorf("app %q has no sticky table", appName)
+		}
+		return app.sticky.clear(client), nil
+	}
+	return 0, errors.Errorf("unknown app %q", appName)
+}
+
+// DispatcherStats returns stats of the dispatcher which executes IO operations.
+func (p Proxy) DispatcherStats() dispatcher.Stats {
+	return p.dispatcher.Stats()
 }
 
 // ProxyConfig represents Proxy config file.
 type ProxyConfig struct {
 	Apps []ConfigApp
+	// Poller is the poller implementation of reactors: "epoll", "portable" or "io_uring".
+	// Empty value means "epoll" in linux and "portable" in other systems.
+	// "io_uring" falls back to "epoll" if the kernel doesn't support it.
+	Poller string
+	// EdgeTriggered enables edge-triggered mode of "epoll" poller.
+	EdgeTriggered bool
+	Reactors      ConfigReactors
+	Dispatcher    ConfigDispatcher
+}
+
+// ConfigReactors represents config of the reactors pool. Every reactor has its poller and serves its share of connections.
+// Zero Count means GOMAXPROCS reactors. Assign is the way of assigning new connections to reactors:
+// "hash" (default) of the incoming connection fd or "least-load".
+type ConfigReactors struct {
+	Count  int
+	Assign string
+}
+
+// ConfigDispatcher represents config of the dispatcher which executes IO operations for poller events.
+// Zero Workers means GOMAXPROCS workers, zero QueueSize means 1024 tasks.
+// Overflow is the full queue policy: "block" (default) or "caller-runs".
+type ConfigDispatcher struct {
+	Workers   int
+	QueueSize int
+	Overflow  string
 }
 
 type ConfigApp struct {
 	Name    string
 	Ports   []int
-	Targets []string
+	Targets []ConfigTarget
+	// MinHealthy is the min number of available backends, which are chosen from the preferred priority tiers.
+	// When preferred tiers have fewer available backends, the next tier gets traffic too. Zero means 1.
+	MinHealthy int
+	// Relay is the way of relaying data: "copy" (default) through the user space buffer or "splice" with splice(2) through the pipe.
+	Relay string
+	// Balancer is the strategy of choosing backends: "least-conn" (default), "round-robin", "random", "p2c" (power of two choices),
+	// "least-latency", "peak-ewma" or "consistent-hash" of the client address.
+	Balancer string
+	// HashBy is the part of the client address hashed by "consistent-hash" balancer: "addr" (default, IP and port) or "ip".
+	HashBy string
+	Sticky ConfigSticky
+	Retry  ConfigRetry
+	Queue  ConfigQueue
+	// ConnectTimeout is the timeout of connects to backends for clients. Zero means 2 seconds.
+	ConnectTimeout time.Duration
+	// Healthcheck is the healthcheck config of app backends. It is overridden by non-zero fields of target healthcheck configs.
+	Healthcheck ConfigHealthcheck
+	// SlowStart is the window after recovery of the backend, during which its effective weight rises from 10% to the full weight.
+	// Zero SlowStart disables slow-start.
+	SlowStart time.Duration
+	// Listeners is the number of SO_REUSEPORT listeners of every port. Zero means one listener without SO_REUSEPORT.
+	Listeners int
+}
+
+// ConfigSticky represents config of the sticky table of the app, which maps client IPs to their backends.
+// Zero TTL disables the table. TTL is the idle time of the entry, zero MaxSize means 65536 entries.
+type ConfigSticky struct {
+	TTL     time.Duration
+	MaxSize int
+}
+
+// ConfigRetry represents config of connecting the client to other backends when the connect fails.
+// Attempts is the max number of connects for one client, zero means 1 (no retries). ExcludeTried excludes already tried backends
+// from next attempts. Backoff is the pause between attempts. Deadline limits all attempts, zero means no limit except connect timeouts.
+type ConfigRetry struct {
+	Attempts     int
+	ExcludeTried bool
+	Backoff      time.Duration
+	Deadline     time.Duration
+}
+
+// ConfigQueue represents config of the app queue of clients, which wait for available backends,
+// when all active backends are at max connections or there are no active backends.
+// Zero Size disables the queue, so such clients are closed immediately. Zero Timeout means 5 seconds.
+type ConfigQueue struct {
+	Size    int
+	Timeout time.Duration
+}
+
+// ConfigHealthcheck represents config of active health checks of the backend. Interval is the time between checks (default 5s),
+// Timeout is the connect timeout of the check (default 2s), and the random delay up to Jitter is added to every interval.
+// The inactive backend becomes active after Rise consecutive successful checks, and the active backend becomes inactive
+// after Fall consecutive failed checks (failed connects for clients are counted too). Zero Rise and Fall mean 1.
+// Type is the check type: "tcp" (default, only connect), "http" or "script". The type and its settings are taken from the target config if its Type is set.
+type ConfigHealthcheck struct {
+	Type     string
+	HTTP     ConfigHTTPCheck
+	Script   []ConfigCheckStep
+	Interval time.Duration
+	Timeout  time.Duration
+	Jitter   time.Duration
+	Rise     int
+	Fall     int
+}
+
+// ConfigHTTPCheck represents config of "http" healthcheck. Method is "GET" by default, Path is "/" by default.
+// The check passes if the response status is in ExpectStatus range ("200-399" by default, or the single status like "200"),
+// and the response body (its first 64 KiB) matches ExpectBody regex if it is set.
+type ConfigHTTPCheck struct {
+	Method       string
+	Path         string
+	Headers      map[string]string
+	ExpectStatus string
+	ExpectBody   string
+}
+
+// ConfigCheckStep represents one step of "script" healthcheck. The step sends Send data (if it is set),
+// and after that it reads the response until it starts with Expect data or until it matches ExpectRegex (if one of them is set).
+// The step fails after Timeout, and the whole script fails after the healthcheck timeout.
+type ConfigCheckStep struct {
+	Send        string
+	Expect      string
+	ExpectRegex string
+	Timeout     time.Duration
+}
+
+// ConfigTarget represents config of the app backend.
+// Weight is the relative capacity of the backend which is honoured by balancers. Zero Weight means no new connections.
+// Priority is the tier of the backend. Backends of the lowest tier with available backends get new connections,
+// so backends of higher tiers are standbys. MaxConnections limits connections of the backend, zero means no limit.
+type ConfigTarget struct {
+	Address        string
+	Weight         int
+	Priority       int
+	MaxConnections int
+	Healthcheck    ConfigHealthcheck
 }
@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"golang.org/x/sys/unix"
+
+	"github.com/hotafrika/tcp_proxy_epoll/pkg/poller"
+)
+
+// freePort returns the port which is free for listening.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// testPollers returns poller kinds which are available on the system.
+func testPollers() []string {
+	if runtime.GOOS == "linux" {
+		return []string{"epoll", "portable"}
+	}
+	return []string{"portable"}
+}
+
+// runProxy starts the proxy and returns the channel of the Run() result.
+func runProxy(t *testing.T, config ProxyConfig) (Proxy, <-chan error) {
+	t.Helper()
+	logger := zerolog.Nop()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	p, err := NewProxy(ctx, &logger, config)
+	if err != nil {
+		t.Fatalf("NewProxy(): %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run()
+	}()
+	return p, done
+}
+
+// waitRun waits for the Run() result.
+func waitRun(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(3 * time.Second):
+		t.Fatal("Run() didn't return")
+		return nil
+	}
+}
+
+func TestRunReturnsOnFailure(t *testing.T) {
+	for _, kind := range testPollers() {
+		t.Run(kind, func(t *testing.T) {
+			p, done := runProxy(t, ProxyConfig{
+				Poller: kind,
+				Apps: []ConfigApp{{
+					Name:    "test",
+					Ports:   []int{freePort(t)},
+					Targets: []ConfigTarget{{Address: "127.0.0.1:1", Weight: 1}},
+				}},
+			})
+			time.Sleep(100 * time.Millisecond)
+
+			// reactors fail the proxy like this after failed waits
+			p.failure.fail(errors.New("reactor 0 failed"))
+			err := waitRun(t, done)
+			if err == nil || err.Error() != "reactor 0 failed" {
+				t.Errorf("Run() = %v, want reactor error", err)
+			}
+		})
+	}
+}
+
+// failingPoller refuses to register relayed connections, like the poller which is out of fds.
+type failingPoller struct {
+	poller.Poller
+}
+
+func (p failingPoller) Add(fd int, interest poller.Interest) error {
+	if interest == poller.Readable|poller.OneShot {
+		return unix.EMFILE
+	}
+	return p.Poller.Add(fd, interest)
+}
+
+func TestRelayClosedOnFailedRegistration(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer backendLn.Close()
+	go func() {
+		for {
+			conn, err := backendLn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	for _, kind := range testPollers() {
+		t.Run(kind, func(t *testing.T) {
+			port := freePort(t)
+			logger := zerolog.Nop()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			p, err := NewProxy(ctx, &logger, ProxyConfig{
+				Poller: kind,
+				Apps: []ConfigApp{{
+					Name:    "test",
+					Ports:   []int{port},
+					Targets: []ConfigTarget{{Address: backendLn.Addr().String(), Weight: 1}},
+				}},
+			})
+			if err != nil {
+				t.Fatalf("NewProxy(): %v", err)
+			}
+			for _, r := range p.reactors.reactors {
+				r.poller = failingPoller{r.poller}
+			}
+			done := make(chan error, 1)
+			go func() {
+				done <- p.Run()
+			}()
+			defer func() {
+				cancel()
+				waitRun(t, done)
+			}()
+
+			var client net.Conn
+			for i := 0; i < 50; i++ {
+				client, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+				if err == nil {
+					break
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatalf("Dial(): %v", err)
+			}
+			defer client.Close()
+
+			// the client is closed instead of hanging
+			_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+				t.Fatalf("Read() = %v, want EOF", err)
+			}
+			b := p.bnds[0]
+			for i := 0; i < 50 && b.slots.Load() != 0; i++ {
+				time.Sleep(20 * time.Millisecond)
+			}
+			if n := b.slots.Load(); n != 0 {
+				t.Errorf("backend slots = %d, want 0", n)
+			}
+			if n := b.getConnCount(); n != 0 {
+				t.Errorf("backend connections = %d, want 0", n)
+			}
+		})
+	}
+}
+
+// listenerFailingPoller refuses to register listening sockets.
+type listenerFailingPoller struct {
+	poller.Poller
+}
+
+func (p listenerFailingPoller) Add(fd int, interest poller.Interest) error {
+	if interest&poller.OneShot == 0 {
+		return unix.ENOMEM
+	}
+	return p.Poller.Add(fd, interest)
+}
+
+func TestRunReturnsOnFrontendFailure(t *testing.T) {
+	for _, kind := range testPollers() {
+		t.Run(kind, func(t *testing.T) {
+			logger := zerolog.Nop()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			p, err := NewProxy(ctx, &logger, ProxyConfig{
+				Poller: kind,
+				Apps: []ConfigApp{{
+					Name:    "test",
+					Ports:   []int{freePort(t)},
+					Targets: []ConfigTarget{{Address: "127.0.0.1:1", Weight: 1}},
+				}},
+			})
+			if err != nil {
+				t.Fatalf("NewProxy(): %v", err)
+			}
+			for _, r := range p.reactors.reactors {
+				r.poller = listenerFailingPoller{r.poller}
+			}
+			done := make(chan error, 1)
+			go func() {
+				done <- p.Run()
+			}()
+			err = waitRun(t, done)
+			if !errors.Is(err, unix.ENOMEM) {
+				t.Errorf("Run() = %v, want addListener() error", err)
+			}
+		})
+	}
+}
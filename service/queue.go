@@ -0,0 +1,135 @@
+package service
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// clientQueue is the bounded FIFO queue of clients waiting for available backends of the app.
+type clientQueue struct {
+	size    int
+	timeout time.Duration
+
+	mu sync.Mutex
+	// waiters is the list of *waiter ordered by seq, the first waiter is at the front.
+	waiters *list.List
+	seq     uint64
+}
+
+// waiter is the queued client. Exactly one of wake and expire is called, by the one who removes the waiter from the queue.
+type waiter struct {
+	// seq is the place of the client in the queue. The client keeps it when it waits again after wake.
+	seq      uint64
+	deadline time.Time
+	wake     func()
+	expire   func()
+	elem     *list.Element
+	timer    *time.Timer
+}
+
+func newClientQueue(size int, timeout time.Duration) *clientQueue {
+	return &clientQueue{
+		size:    size,
+		timeout: timeout,
+		waiters: list.New(),
+	}
+}
+
+// wait adds the client to the end of the queue until deadline.
+// wake is called when a backend may be available, expire is called after deadline.
+// It returns nil if the queue is full.
+func (q *clientQueue) wait(deadline time.Time, wake func(), expire func()) *waiter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.waiters.Len() >= q.size {
+		return nil
+	}
+	q.seq++
+	w := &waiter{
+		seq:      q.seq,
+		deadline: deadline,
+	}
+	q.insert(w, wake, expire)
+	return w
+}
+
+// waitAgain returns the woken client, which couldn't get a backend, to its place in the queue.
+// If pass is set, the released slot is unusable only for this client (e.g. its backend is excluded),
+// so the wakeup is passed to the next waiter.
+func (q *clientQueue) waitAgain(w *waiter, pass bool, wake func(), expire func()) {
+	q.mu.Lock()
+	q.insert(w, wake, expire)
+	var next *waiter
+	if pass {
+		next = q.pop(w.elem.Next())
+	}
+	q.mu.Unlock()
+
+	if next != nil {
+		next.timer.Stop()
+		next.wake()
+	}
+}
+
+// insert puts the waiter to its place in the queue and starts its timer. mu must be held by the caller.
+func (q *clientQueue) insert(w *waiter, wake func(), expire func()) {
+	w.wake = wake
+	w.expire = expire
+	// woken clients wait again at the front, so the place is searched from the front
+	w.elem = nil
+	for elem := q.waiters.Front(); elem != nil; elem = elem.Next() {
+		if elem.Value.(*waiter).seq > w.seq {
+			w.elem = q.waiters.InsertBefore(w, elem)
+			break
+		}
+	}
+	if w.elem == nil {
+		w.elem = q.waiters.PushBack(w)
+	}
+	w.timer = time.AfterFunc(time.Until(w.deadline), func() {
+		if q.remove(w) {
+			w.expire()
+		}
+	})
+}
+
+// remove removes the waiter from the queue. It returns false if the waiter was already removed.
+func (q *clientQueue) remove(w *waiter) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if w.elem == nil {
+		return false
+	}
+	q.waiters.Remove(w.elem)
+	w.elem = nil
+	return true
+}
+
+// pop removes the waiter of elem from the queue. It returns nil if elem is nil. mu must be held by the caller.
+func (q *clientQueue) pop(elem *list.Element) *waiter {
+	if elem == nil {
+		return nil
+	}
+	w := q.waiters.Remove(elem).(*waiter)
+	w.elem = nil
+	return w
+}
+
+// notify wakes up the first waiter, or all waiters if all is set.
+func (q *clientQueue) notify(all bool) {
+	var woken []*waiter
+	q.mu.Lock()
+	for w := q.pop(q.waiters.Front()); w != nil; w = q.pop(q.waiters.Front()) {
+		woken = append(woken, w)
+		if !all {
+			break
+		}
+	}
+	q.mu.Unlock()
+
+	for _, w := range woken {
+		w.timer.Stop()
+		w.wake()
+	}
+}
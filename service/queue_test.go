@@ -0,0 +1,151 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWaiters records wakeups and expirations of queued clients.
+type testWaiters struct {
+	events  strings.Builder
+	waiters map[string]*waiter
+}
+
+func (tw *testWaiters) wait(t *testing.T, q *clientQueue, name string, timeout time.Duration) bool {
+	t.Helper()
+	w := q.wait(time.Now().Add(timeout), tw.wake(name), tw.expire(name))
+	if w == nil {
+		return false
+	}
+	tw.waiters[name] = w
+	return true
+}
+
+func (tw *testWaiters) waitAgain(q *clientQueue, name string, pass bool) {
+	q.waitAgain(tw.waiters[name], pass, tw.wake(name), tw.expire(name))
+}
+
+func (tw *testWaiters) wake(name string) func() {
+	return func() {
+		tw.events.WriteString("+" + name)
+	}
+}
+
+func (tw *testWaiters) expire(name string) func() {
+	return func() {
+		tw.events.WriteString("-" + name)
+	}
+}
+
+func TestClientQueue(t *testing.T) {
+	type op struct {
+		// wait queues the client, again returns the woken client to the queue and passes the wakeup if pass is set
+		wait, again string
+		pass        bool
+		// notify wakes up the first waiter, or all of them if all is set
+		notify, all bool
+	}
+	tests := []struct {
+		name string
+		ops  []op
+		want string
+	}{
+		{
+			name: "fifo",
+			ops:  []op{{wait: "a"}, {wait: "b"}, {wait: "c"}, {notify: true}, {notify: true}, {notify: true}, {notify: true}},
+			want: "+a+b+c",
+		},
+		{
+			name: "all",
+			ops:  []op{{wait: "a"}, {wait: "b"}, {wait: "c"}, {notify: true, all: true}, {notify: true}},
+			want: "+a+b+c",
+		},
+		{
+			name: "woken client keeps its place",
+			ops:  []op{{wait: "a"}, {wait: "b"}, {notify: true}, {again: "a"}, {wait: "c"}, {notify: true}, {notify: true}},
+			want: "+a+a+b",
+		},
+		{
+			name: "clients woken by all keep their order",
+			ops:  []op{{wait: "a"}, {wait: "b"}, {wait: "c"}, {notify: true, all: true}, {again: "b"}, {again: "a"}, {notify: true}, {notify: true}},
+			want: "+a+b+c+a+b",
+		},
+		{
+			name: "wakeup is passed to the next client",
+			ops:  []op{{wait: "a"}, {wait: "b"}, {wait: "c"}, {notify: true}, {again: "a", pass: true}, {notify: true}},
+			want: "+a+b+a",
+		},
+		{
+			name: "passed wakeup stops at the end",
+			ops:  []op{{wait: "a"}, {wait: "b"}, {notify: true}, {again: "a", pass: true}, {again: "b", pass: true}, {notify: true}},
+			want: "+a+b+a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newClientQueue(10, time.Minute)
+			tw := &testWaiters{waiters: make(map[string]*waiter)}
+			for _, o := range tt.ops {
+				switch {
+				case o.wait != "":
+					tw.wait(t, q, o.wait, time.Minute)
+				case o.again != "":
+					tw.waitAgain(q, o.again, o.pass)
+				case o.notify:
+					q.notify(o.all)
+				}
+			}
+			if got := tw.events.String(); got != tt.want {
+				t.Errorf("events = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientQueueFull(t *testing.T) {
+	q := newClientQueue(2, time.Minute)
+	tw := &testWaiters{waiters: make(map[string]*waiter)}
+	if !tw.wait(t, q, "a", time.Minute) || !tw.wait(t, q, "b", time.Minute) {
+		t.Fatal("wait() failed in not full queue")
+	}
+	if tw.wait(t, q, "c", time.Minute) {
+		t.Error("wait() succeeded in full queue")
+	}
+	// the woken client returns to the queue even if it is full
+	q.notify(false)
+	tw.wait(t, q, "c", time.Minute)
+	tw.waitAgain(q, "a", false)
+	q.notify(true)
+	if got, want := tw.events.String(), "+a+a+b+c"; got != want {
+		t.Errorf("events = %s, want %s", got, want)
+	}
+}
+
+func TestClientQueueExpire(t *testing.T) {
+	q := newClientQueue(10, time.Minute)
+	expired := make(chan string, 2)
+	q.wait(time.Now().Add(10*time.Millisecond), func() {
+		t.Error("expired client is woken up")
+	}, func() {
+		expired <- "a"
+	})
+	w := q.wait(time.Now().Add(time.Minute), func() {}, func() {
+		t.Error("client is expired before its deadline")
+	})
+	if got := <-expired; got != "a" {
+		t.Errorf("expired %s, want a", got)
+	}
+	// the client which waits again keeps its deadline
+	q.notify(false)
+	w.deadline = time.Now().Add(10 * time.Millisecond)
+	q.waitAgain(w, false, func() {
+		t.Error("expired client is woken up")
+	}, func() {
+		expired <- "b"
+	})
+	if got := <-expired; got != "b" {
+		t.Errorf("expired %s, want b", got)
+	}
+	q.notify(true)
+}
@@ -0,0 +1,470 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hotafrika/tcp_proxy_epoll/pkg/dispatcher"
+	"github.com/hotafrika/tcp_proxy_epoll/pkg/poller"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"golang.org/x/sys/unix"
+)
+
+// reactor is the event loop of the poller shared by frontends and backends.
+// It serves events of connections assigned to it, and IO operations are executed by the dispatcher.
+type reactor struct {
+	ctx         context.Context
+	logger      *zerolog.Logger
+	id          int
+	rmu         sync.RWMutex
+	connections map[int]*PipedConn
+	// writers are stalled connections by wfd of their B-legs.
+	writers map[int]*PipedConn
+	// acceptors are accept loops of listening sockets registered in the reactor.
+	acceptors map[int]*acceptor
+	// cmu protects pending connects and their timers.
+	cmu        sync.Mutex
+	connects   map[int]*pendingConnect
+	timers     connectTimers
+	timer      *time.Timer
+	timerAt    time.Time
+	poller     poller.Poller
+	dispatcher *dispatcher.Dispatcher
+	// load is the number of connections of the reactor.
+	load atomic.Int64
+	// closing are released connections, which are closed after the current batch of events.
+	// The batch can have stale events of their fds, so fds can't be reused by new connections until it is served.
+	closeMu sync.Mutex
+	closing []*Conn
+	stopped bool
+	// fail stops the proxy with the error, when the reactor can't serve its connections anymore.
+	fail func(error)
+}
+
+// acceptor is the accept loop of the listening socket registered in the reactor.
+type acceptor struct {
+	// accept returns errFdExhausted if the process or the system is out of fds.
+	accept   func() error
+	interest poller.Interest
+	// paused is set while the listening socket is deleted from poller after fd exhaustion.
+	paused bool
+}
+
+var (
+	errFdExhausted = errors.New("fds are exhausted")
+)
+
+const (
+	// acceptPauseDelay is the time during which the listening socket isn't served after fd exhaustion.
+	// Pending connections stay in the backlog, so the reactor neither spins on the listener event nor loses the edge.
+	acceptPauseDelay = 100 * time.Millisecond
+	// maxWaitFailures is the number of consecutive WaitContext failures after which the reactor fails the proxy.
+	maxWaitFailures = 10
+	// waitRetryDelay is the delay before WaitContext is retried after failure.
+	waitRetryDelay = 100 * time.Millisecond
+)
+
+func newReactor(ctx context.Context, logger *zerolog.Logger, id int, newPoller func() (poller.Poller, error), dispatcher *dispatcher.Dispatcher, fail func(error)) (*reactor, error) {
+	plr, err := newPoller()
+	if err != nil {
+		return nil, errors.Wrap(err, "newPoller()")
+	}
+	return &reactor{
+		ctx:         ctx,
+		logger:      logger,
+		id:          id,
+		connections: make(map[int]*PipedConn),
+		writers:     make(map[int]*PipedConn),
+		acceptors:   make(map[int]*acceptor),
+		connects:    make(map[int]*pendingConnect),
+		poller:      plr,
+		dispatcher:  dispatcher,
+		fail:        fail,
+	}, nil
+}
+
+// addConn adds connection to the connections map and its fd to poller with OneShot interest.
+func (r *reactor) addConn(conn *PipedConn) error {
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+	err := r.poller.Add(conn.fd, poller.Readable|poller.OneShot)
+	if err != nil {
+		return errors.Wrap(err, "Add()")
+	}
+	r.connections[conn.fd] = conn
+	r.load.Add(1)
+	return nil
+}
+
+// addListener registers the listening socket. accept is called in the reactor goroutine on every listener event.
+// The listener shared by several reactors is registered with Exclusive interest, so a new connection wakes only one of them.
+func (r *reactor) addListener(fd int, shared bool, accept func() error) error {
+	interest := poller.Readable
+	if shared {
+		interest |= poller.Exclusive
+	}
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+	r.acceptors[fd] = &acceptor{
+		accept:   accept,
+		interest: interest,
+	}
+	err := r.poller.Add(fd, interest)
+	if err != nil {
+		delete(r.acceptors, fd)
+		return errors.Wrap(err, "Add()")
+	}
+	return nil
+}
+
+// delListener deletes the listening socket from poller.
+func (r *reactor) delListener(fd int) {
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+	a, ok := r.acceptors[fd]
+	if !ok {
+		return
+	}
+	if !a.paused {
+		r.poller.Del(fd)
+	}
+	delete(r.acceptors, fd)
+}
+
+// pauseListener deletes the listening socket from poller after fd exhaustion and adds it again after acceptPauseDelay.
+// The listener can't be disabled with Mod, because Exclusive interest can't be modified.
+func (r *reactor) pauseListener(fd int, err error) {
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+	a, ok := r.acceptors[fd]
+	if !ok || a.paused {
+		return
+	}
+	r.logger.Warn().Err(err).Int("reactor", r.id).Msg("listener is paused")
+	r.poller.Del(fd)
+	a.paused = true
+	time.AfterFunc(acceptPauseDelay, func() {
+		r.resumeListener(fd)
+	})
+}
+
+// resumeListener adds the paused listening socket to poller again. Pending connections are reported right after it.
+// Adding may fail while fds are still exhausted (the portable poller duplicates fd), so it is retried after acceptPauseDelay.
+func (r *reactor) resumeListener(fd int) {
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+	a, ok := r.acceptors[fd]
+	if !ok || !a.paused || r.ctx.Err() != nil {
+		return
+	}
+	err := r.poller.Add(fd, a.interest)
+	if err != nil {
+		r.logger.Warn().Err(err).Int("reactor", r.id).Msg("Add() of paused listener")
+		time.AfterFunc(acceptPauseDelay, func() {
+			r.resumeListener(fd)
+		})
+		return
+	}
+	a.paused = false
+}
+
+// detach deletes fd and wfd of the connection from poller and the connection from maps.
+// Both fds are closed by the last release of the pair.
+func (r *reactor) detach(conn *Conn) {
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+	if conn.wfd >= 0 {
+		if _, ok := r.writers[conn.wfd]; ok {
+			r.poller.Del(conn.wfd)
+			delete(r.writers, conn.wfd)
+		}
+	}
+	if _, ok := r.connections[conn.fd]; !ok {
+		return
+	}
+	r.poller.Del(conn.fd)
+	delete(r.connections, conn.fd)
+	r.load.Add(-1)
+}
+
+// closeLater closes detached connections after the current batch of events. The stopped reactor closes them right away.
+func (r *reactor) closeLater(conns ...*Conn) {
+	r.closeMu.Lock()
+	if r.stopped {
+		r.closeMu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return
+	}
+	// the reactor may wait for events, so it is woken up by the first connection of the batch
+	wake := len(r.closing) == 0
+	r.closing = append(r.closing, conns...)
+	r.closeMu.Unlock()
+	if wake {
+		_ = r.poller.Wake()
+	}
+}
+
+// closeReleased closes connections released before the end of the current batch of events.
+// If stop is set, connections released later are closed right away.
+func (r *reactor) closeReleased(stop bool) {
+	r.closeMu.Lock()
+	closing := r.closing
+	r.closing = nil
+	r.stopped = stop
+	r.closeMu.Unlock()
+	for _, conn := range closing {
+		conn.Close()
+	}
+}
+
+// rearm enables the connection fd after reading until EAGAIN.
+func (r *reactor) rearm(fd int) error {
+	err := r.poller.Rearm(fd, poller.Readable)
+	if err != nil {
+		return errors.Wrap(err, "Rearm()")
+	}
+	return nil
+}
+
+// awaitWritable enables wfd of B-leg of the stalled connection, so the connection is served again when B-leg becomes writable.
+// wfd is created and registered on the first stall of the connection. It is changed only under rmu,
+// and the detached connection doesn't get wfd anymore, so detach and Close see the same wfd.
+func (r *reactor) awaitWritable(conn *PipedConn) error {
+	out := conn.pipeTo
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+	if r.connections[conn.fd] != conn {
+		return errDetached
+	}
+	if out.wfd >= 0 {
+		err := r.poller.Rearm(out.wfd, poller.Writable)
+		if err != nil {
+			return errors.Wrap(err, "Rearm()")
+		}
+		return nil
+	}
+
+	wfd, err := unix.FcntlInt(uintptr(out.fd), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return errors.Wrap(err, "F_DUPFD_CLOEXEC")
+	}
+	err = r.poller.Add(wfd, poller.Writable|poller.OneShot)
+	if err != nil {
+		unix.Close(wfd)
+		return errors.Wrap(err, "Add()")
+	}
+	out.wfd = wfd
+	r.writers[wfd] = conn
+	return nil
+}
+
+// getConnByFD returns connection by fd of its A-leg or stalled connection by wfd of its B-leg.
+// It acquires the returned connection, so its fds are not closed until release.
+func (r *reactor) getConnByFD(fd int) (conn *PipedConn, writer *PipedConn) {
+	r.rmu.RLock()
+	defer r.rmu.RUnlock()
+	conn, writer = r.connections[fd], r.writers[fd]
+	if conn != nil {
+		conn.acquire()
+	}
+	if writer != nil {
+		writer.acquire()
+	}
+	return conn, writer
+}
+
+// getAcceptor returns the accept loop of the listening socket.
+func (r *reactor) getAcceptor(fd int) func() error {
+	r.rmu.RLock()
+	defer r.rmu.RUnlock()
+	if a, ok := r.acceptors[fd]; ok {
+		return a.accept
+	}
+	return nil
+}
+
+// run is a blocking function. It serves poller events and expires pending connects until ctx is done.
+// Failed WaitContext is retried, and the proxy is failed after maxWaitFailures consecutive failures,
+// because connections of the reactor can't be served without it.
+// It fails the rest of pending connects and closes poller on exit.
+func (r *reactor) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer r.poller.Close()
+	defer r.closeReleased(true)
+	defer func() {
+		r.cmu.Lock()
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		r.cmu.Unlock()
+		r.expireConnects(time.Now(), errors.Wrap(r.ctx.Err(), "reactor is stopped"))
+	}()
+	failures := 0
+	for {
+		events, err := r.poller.WaitContext(r.ctx)
+		if err != nil {
+			if r.ctx.Err() != nil {
+				return
+			}
+			r.logger.Error().Err(err).Int("reactor", r.id).Msg("WaitContext()")
+			failures++
+			if failures >= maxWaitFailures {
+				r.fail(errors.Wrapf(err, "reactor %d failed", r.id))
+				return
+			}
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(waitRetryDelay):
+			}
+			continue
+		}
+		failures = 0
+		for _, event := range events {
+			r.serveEvent(event)
+		}
+		r.closeReleased(false)
+		// the reactor timer wakes up WaitContext when the nearest connect deadline is passed
+		r.expireConnects(time.Now(), nil)
+	}
+}
+
+// serveEvent dispatches IO operation of the event. The fd of the event is disabled until the IO operation rearms it.
+// Every event of A-leg fd (including hang up and error) is served by reading,
+// so the connection is finalized only by the goroutine which owns it.
+func (r *reactor) serveEvent(event poller.Event) {
+	if accept := r.getAcceptor(event.Fd); accept != nil {
+		err := accept()
+		switch {
+		case errors.Is(err, errFdExhausted):
+			r.pauseListener(event.Fd, err)
+		case err != nil:
+			r.logger.Error().Err(err).Int("reactor", r.id).Msg("accept()")
+		}
+		return
+	}
+	if r.completeConnect(event.Fd) {
+		return
+	}
+
+	conn, writer := r.getConnByFD(event.Fd)
+	if conn != nil {
+		r.dispatcher.Submit(func() {
+			conn.manager.serveConn(conn)
+			conn.release()
+		})
+		return
+	}
+
+	// B-leg of the stalled connection became writable, so the connection can be served again.
+	if writer == nil {
+		return
+	}
+	if !writer.unstall() {
+		writer.release()
+		return
+	}
+	r.dispatcher.Submit(func() {
+		writer.manager.serveConn(writer)
+		writer.release()
+	})
+}
+
+// reactorPool is the pool of reactors shared by all frontends and backends.
+// Both legs of the proxied connection are assigned to the same reactor.
+type reactorPool struct {
+	reactors []*reactor
+	assign   assignPolicy
+	// nextIdx is the index of the next reactor for listeners.
+	nextIdx atomic.Uint64
+}
+
+// assignPolicy is the way of assigning connections to reactors.
+type assignPolicy int
+
+const (
+	// assignHash assigns the connection to the reactor by hash of the incoming connection fd.
+	assignHash assignPolicy = iota
+	// assignLeastLoad assigns the connection to the reactor with the least number of connections.
+	assignLeastLoad
+)
+
+func parseAssignPolicy(name string) (assignPolicy, error) {
+	switch name {
+	case "", "hash":
+		return assignHash, nil
+	case "least-load":
+		return assignLeastLoad, nil
+	default:
+		return 0, errors.Errorf("unknown reactor assign policy %q", name)
+	}
+}
+
+func newReactorPool(ctx context.Context, logger *zerolog.Logger, count int, assign assignPolicy, newPoller func() (poller.Poller, error), dispatcher *dispatcher.Dispatcher, fail func(error)) (*reactorPool, error) {
+	if count <= 0 {
+		return nil, errors.Errorf("invalid reactors count %d", count)
+	}
+	p := &reactorPool{
+		reactors: make([]*reactor, 0, count),
+		assign:   assign,
+	}
+	for i := 0; i < count; i++ {
+		r, err := newReactor(ctx, logger, i, newPoller, dispatcher, fail)
+		if err != nil {
+			p.close()
+			return nil, errors.Wrap(err, "newReactor()")
+		}
+		p.reactors = append(p.reactors, r)
+	}
+	return p, nil
+}
+
+// pick returns the reactor for the new connection with the incoming connection fd.
+func (p *reactorPool) pick(fd int) *reactor {
+	if p.assign == assignLeastLoad {
+		next := p.reactors[0]
+		minLoad := next.load.Load()
+		for _, r := range p.reactors[1:] {
+			if load := r.load.Load(); load < minLoad {
+				next, minLoad = r, load
+			}
+		}
+		return next
+	}
+	return p.reactors[fd%len(p.reactors)]
+}
+
+// next returns reactors one by one. It is used to tie SO_REUSEPORT listeners to reactors.
+func (p *reactorPool) next() *reactor {
+	idx := p.nextIdx.Add(1) - 1
+	return p.reactors[idx%uint64(len(p.reactors))]
+}
+
+// run starts all reactors. wg is done when every reactor exits.
+func (p *reactorPool) run(wg *sync.WaitGroup) {
+	for _, r := range p.reactors {
+		wg.Add(1)
+		go r.run(wg)
+	}
+}
+
+// close closes pollers of reactors which weren't run.
+func (p *reactorPool) close() {
+	for _, r := range p.reactors {
+		r.poller.Close()
+	}
+}
+
+// loads returns the number of connections of every reactor.
+func (p *reactorPool) loads() []int64 {
+	loads := make([]int64, 0, len(p.reactors))
+	for _, r := range p.reactors {
+		loads = append(loads, r.load.Load())
+	}
+	return loads
+}
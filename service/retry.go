@@ -0,0 +1,160 @@
+package service
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// retryPolicy defines how the app connects the client to its backends when the connect fails.
+type retryPolicy struct {
+	// attempts is the max number of connects for one client, it is at least 1.
+	attempts int
+	// excludeTried excludes already tried backends from next attempts.
+	excludeTried bool
+	// backoff is the pause between attempts.
+	backoff time.Duration
+	// deadline limits all attempts of the client. Zero deadline means only the connect timeout of every attempt.
+	deadline time.Duration
+}
+
+// remoteConnect is the state of connecting the client to backends of the app with retries.
+type remoteConnect struct {
+	app    *application
+	r      *reactor
+	client net.Addr
+	// deadline is zero if the retry policy has no deadline.
+	deadline time.Time
+	attempt  int
+	tried    []*backend
+	// waiter is the place of the client in the app queue. It is set when the client is queued for the first time.
+	waiter *waiter
+	done   func(*Conn, error)
+}
+
+// newRemoteConnect creates the connect state. r is nil in io_uring mode.
+func newRemoteConnect(app *application, r *reactor, client net.Addr, done func(*Conn, error)) *remoteConnect {
+	c := &remoteConnect{
+		app:    app,
+		r:      r,
+		client: client,
+		done:   done,
+	}
+	if app.retry.deadline > 0 {
+		c.deadline = time.Now().Add(app.retry.deadline)
+	}
+	return c
+}
+
+// next chooses the backend for the next attempt. The connection slot of the backend is reserved.
+func (c *remoteConnect) next() (*backend, time.Duration, error) {
+	var exclude []*backend
+	if c.app.retry.excludeTried {
+		exclude = c.tried
+	}
+	bnd, err := c.app.nextBackend(c.client, exclude)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.attempt++
+	c.tried = append(c.tried, bnd)
+	timeout := bnd.connectTimeout
+	if !c.deadline.IsZero() {
+		if remaining := time.Until(c.deadline); remaining < timeout {
+			timeout = remaining
+		}
+	}
+	return bnd, timeout, nil
+}
+
+// enqueue adds the client to the app queue, when there are no available backends.
+// It returns the error if the app has no queue, or the queue is full.
+func (c *remoteConnect) enqueue(err error, wake func(), expire func()) error {
+	if c.app.queue == nil || !(errors.Is(err, errNoActiveBackend) || errors.Is(err, errBackendsFull)) {
+		return errors.Wrap(err, "unable to get next backend")
+	}
+	if c.waiter != nil {
+		// the woken client couldn't get a backend, so it waits again at its place until the same deadline
+		c.app.queue.waitAgain(c.waiter, c.app.hasFreeSlot(), wake, expire)
+		return nil
+	}
+	deadline := time.Now().Add(c.app.queue.timeout)
+	if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+		deadline = c.deadline
+	}
+	c.waiter = c.app.queue.wait(deadline, wake, expire)
+	if c.waiter == nil {
+		return errors.Wrap(err, "unable to get next backend, queue is full")
+	}
+	return nil
+}
+
+// retry reports if the next attempt can be made after the failed one.
+func (c *remoteConnect) retry(bnd *backend, err error) bool {
+	if c.attempt >= c.app.retry.attempts {
+		return false
+	}
+	if !c.deadline.IsZero() && time.Now().Add(c.app.retry.backoff).After(c.deadline) {
+		return false
+	}
+	c.app.logger.Info().Err(err).Str("app", c.app.name).Str("backend", bnd.addr).Int("attempt", c.attempt).Msg("retrying connect to another backend")
+	return true
+}
+
+// start makes the next non-blocking connect attempt in the reactor.
+// The next attempt after the failed one is started by the timer after the backoff.
+// The client waits in the app queue if there are no available backends.
+func (c *remoteConnect) start() {
+	bnd, timeout, err := c.next()
+	if err != nil {
+		qErr := c.enqueue(err, c.start, func() {
+			c.done(nil, errors.Wrap(err, "unable to get next backend, queue timeout"))
+		})
+		if qErr != nil {
+			c.done(nil, qErr)
+		}
+		return
+	}
+	bnd.connect(c.r, timeout, func(conn *Conn, err error) {
+		if err == nil {
+			c.done(conn, nil)
+			return
+		}
+		if !c.retry(bnd, err) {
+			c.done(nil, errors.Wrap(err, "unable to connect to remote backend"))
+			return
+		}
+		time.AfterFunc(c.app.retry.backoff, c.start)
+	})
+}
+
+// dial makes blocking connect attempts until success, and returns the new remote connection.
+func (c *remoteConnect) dial() (*Conn, error) {
+	for {
+		bnd, timeout, err := c.next()
+		if err != nil {
+			woken := make(chan bool, 1)
+			qErr := c.enqueue(err, func() {
+				woken <- true
+			}, func() {
+				woken <- false
+			})
+			if qErr != nil {
+				return nil, qErr
+			}
+			if !<-woken {
+				return nil, errors.Wrap(err, "unable to get next backend, queue timeout")
+			}
+			continue
+		}
+		conn, err := bnd.createConn(timeout)
+		if err == nil {
+			return conn, nil
+		}
+		if !c.retry(bnd, err) {
+			return nil, errors.Wrap(err, "unable to connect to remote backend")
+		}
+		time.Sleep(c.app.retry.backoff)
+	}
+}
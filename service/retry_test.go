@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// newTestApp creates the app of backends bnds with the least-conn balancer and the retry policy.
+func newTestApp(t *testing.T, bnds []*backend, retry retryPolicy) *application {
+	t.Helper()
+	logger := zerolog.Nop()
+	blr, err := newBalancer("", "", bnds)
+	if err != nil {
+		t.Fatalf("newBalancer(): %v", err)
+	}
+	return newApplication(context.Background(), &logger, "test", bnds, 1, blr, nil, retry, nil, nil)
+}
+
+func TestRemoteConnectNext(t *testing.T) {
+	tests := []struct {
+		name         string
+		excludeTried bool
+		wantErr      error
+	}{
+		{name: "tried backends are excluded", excludeTried: true, wantErr: errAllExcluded},
+		{name: "tried backends are chosen again", excludeTried: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bnds := newTestBackends(t, []int{1, 1, 1}, nil)
+			app := newTestApp(t, bnds, retryPolicy{attempts: 4, excludeTried: tt.excludeTried})
+			c := newRemoteConnect(app, nil, nil, nil)
+
+			seen := make(map[*backend]bool)
+			for i := 0; i < 3; i++ {
+				bnd, _, err := c.next()
+				if err != nil {
+					t.Fatalf("next() error = %v", err)
+				}
+				// the failed attempt releases the slot, so the backend is as loaded as before
+				bnd.release()
+				seen[bnd] = true
+			}
+			if tt.excludeTried && len(seen) != 3 {
+				t.Errorf("next() chose %d different backends of 3", len(seen))
+			}
+			if c.attempt != 3 || len(c.tried) != 3 {
+				t.Errorf("attempt = %d, tried = %d, want 3", c.attempt, len(c.tried))
+			}
+
+			_, _, err := c.next()
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("next() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRemoteConnectNextTimeout(t *testing.T) {
+	bnds := newTestBackends(t, []int{1}, nil)
+	bnds[0].connectTimeout = time.Second
+	app := newTestApp(t, bnds, retryPolicy{attempts: 1, deadline: 100 * time.Millisecond})
+	c := newRemoteConnect(app, nil, nil, nil)
+	_, timeout, err := c.next()
+	if err != nil {
+		t.Fatalf("next() error = %v", err)
+	}
+	if timeout > 100*time.Millisecond {
+		t.Errorf("timeout = %v, want at most the deadline", timeout)
+	}
+}
+
+func TestRemoteConnectRetry(t *testing.T) {
+	tests := []struct {
+		name  string
+		retry retryPolicy
+		want  string
+	}{
+		{name: "single attempt", retry: retryPolicy{attempts: 1}, want: "-"},
+		{name: "attempt limit", retry: retryPolicy{attempts: 3}, want: "++-"},
+		{name: "backoff fits deadline", retry: retryPolicy{attempts: 3, backoff: time.Millisecond, deadline: time.Hour}, want: "++-"},
+		{name: "backoff exceeds deadline", retry: retryPolicy{attempts: 3, backoff: time.Hour, deadline: time.Minute}, want: "-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bnds := newTestBackends(t, []int{1}, nil)
+			app := newTestApp(t, bnds, tt.retry)
+			c := newRemoteConnect(app, nil, nil, nil)
+			got := ""
+			for {
+				bnd, _, err := c.next()
+				if err != nil {
+					t.Fatalf("next() error = %v", err)
+				}
+				bnd.release()
+				if !c.retry(bnd, errors.New("connection refused")) {
+					got += "-"
+					break
+				}
+				got += "+"
+			}
+			if got != tt.want {
+				t.Errorf("retries = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteConnectDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	refused := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+
+	tests := []struct {
+		name         string
+		addrs        []string
+		attempts     int
+		excludeTried bool
+		wantErr      bool
+		wantAttempts []int
+	}{
+		{name: "retried to the working backend", addrs: []string{refused, ln.Addr().String()}, attempts: 2, excludeTried: true, wantAttempts: []int{1, 2}},
+		{name: "attempt limit", addrs: []string{refused, refused}, attempts: 3, wantErr: true, wantAttempts: []int{3}},
+		{name: "all backends are tried", addrs: []string{refused, refused}, attempts: 5, excludeTried: true, wantErr: true, wantAttempts: []int{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bnds := newTestBackends(t, []int{1, 1}, nil)
+			for i, bnd := range bnds {
+				bnd.addr = tt.addrs[i]
+				bnd.connectTimeout = time.Second
+				// failed connects don't take backends down during the test
+				bnd.healthcheck.fall = 10
+			}
+			app := newTestApp(t, bnds, retryPolicy{attempts: tt.attempts, excludeTried: tt.excludeTried})
+			c := newRemoteConnect(app, nil, nil, nil)
+			conn, err := c.dial()
+			if conn != nil {
+				conn.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("dial() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !containsInt(tt.wantAttempts, c.attempt) {
+				t.Errorf("attempts = %d, want one of %v", c.attempt, tt.wantAttempts)
+			}
+			for i, bnd := range bnds {
+				want := int64(0)
+				if conn != nil && conn.manager == bnd {
+					want = 1
+				}
+				if n := bnd.slots.Load(); n != want {
+					t.Errorf("backend %d slots = %d, want %d", i, n, want)
+				}
+			}
+		})
+	}
+}
+
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
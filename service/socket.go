@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// dialPollInterval is the max time of one poll(2) call of dial. ctx is checked between calls.
+const dialPollInterval = 100 * time.Millisecond
+
+// dial connects to the TCP address with the raw non-blocking socket.
+// It waits for the connection with poll(2) until timeout or ctx is done.
+func dial(ctx context.Context, address string, timeout time.Duration) (int, error) {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return -1, errors.Wrap(err, "ResolveTCPAddr()")
+	}
+	fd, err := connectSocket(addr)
+	if err == unix.EINPROGRESS {
+		err = waitConnected(ctx, fd, time.Now().Add(timeout))
+		if err != nil {
+			unix.Close(fd)
+		}
+	}
+	if err != nil {
+		return -1, errors.Wrap(err, "Connect()")
+	}
+	return fd, nil
+}
+
+// connectSocket creates the raw non-blocking socket and starts connecting to the address.
+// It returns fd with unix.EINPROGRESS if the connection is not completed yet. fd is closed on other errors.
+func connectSocket(addr *net.TCPAddr) (int, error) {
+	sa, domain, err := sockaddr(addr)
+	if err != nil {
+		return -1, err
+	}
+	fd, err := unix.Socket(domain, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return -1, errors.Wrap(err, "Socket()")
+	}
+	unix.CloseOnExec(fd)
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return -1, errors.Wrap(err, "SetNonblock()")
+	}
+	setNoDelay(fd)
+
+	err = unix.Connect(fd, sa)
+	if err != nil && err != unix.EINPROGRESS {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, err
+}
+
+// waitConnected waits until the non-blocking connect of fd is completed and returns its result.
+func waitConnected(ctx context.Context, fd int, deadline time.Time) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return unix.ETIMEDOUT
+		}
+		if wait > dialPollInterval {
+			wait = dialPollInterval
+		}
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+		n, err := unix.Poll(fds, int(wait.Milliseconds())+1)
+		if err != nil && err != unix.EINTR {
+			return errors.Wrap(err, "Poll()")
+		}
+		if n > 0 {
+			break
+		}
+	}
+	soErr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil {
+		return errors.Wrap(err, "GetsockoptInt()")
+	}
+	if soErr != 0 {
+		return unix.Errno(soErr)
+	}
+	return nil
+}
+
+// setNoDelay disables Nagle's algorithm like Go runtime does for TCP connections.
+func setNoDelay(fd int) {
+	_ = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1)
+}
+
+// sockaddr converts TCP address to the socket address and its domain.
+func sockaddr(addr *net.TCPAddr) (unix.Sockaddr, int, error) {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		sa := &unix.SockaddrInet4{Port: addr.Port}
+		copy(sa.Addr[:], ip4)
+		return sa, unix.AF_INET, nil
+	}
+	ip6 := addr.IP.To16()
+	if ip6 == nil {
+		return nil, 0, errors.Errorf("invalid IP address %q", addr.IP)
+	}
+	sa := &unix.SockaddrInet6{Port: addr.Port}
+	copy(sa.Addr[:], ip6)
+	if addr.Zone != "" {
+		ifi, err := net.InterfaceByName(addr.Zone)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "InterfaceByName()")
+		}
+		sa.ZoneId = uint32(ifi.Index)
+	}
+	return sa, unix.AF_INET6, nil
+}
+
+// tcpAddr converts the socket address to TCP address. Unknown addresses are converted to the empty address.
+func tcpAddr(sa unix.Sockaddr) *net.TCPAddr {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return &net.TCPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: sa.Port}
+	case *unix.SockaddrInet6:
+		addr := &net.TCPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: sa.Port}
+		if sa.ZoneId != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				addr.Zone = ifi.Name
+			}
+		}
+		return addr
+	}
+	return &net.TCPAddr{}
+}
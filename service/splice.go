@@ -0,0 +1,23 @@
+//go:build !linux
+
+package service
+
+import (
+	"github.com/pkg/errors"
+)
+
+type pipe struct{}
+
+type pipePool struct{}
+
+func newPipePool(size int) (*pipePool, error) {
+	return nil, errors.New("splice relay is implemented only for linux")
+}
+
+func (p *pipePool) close() {}
+
+func (c *PipedConn) serveSplice() error {
+	return errors.New("splice relay is implemented only for linux")
+}
+
+func (c *PipedConn) releasePipe() {}
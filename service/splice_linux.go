@@ -0,0 +1,156 @@
+//go:build linux
+
+package service
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// pipeSize is the max number of bytes moved by one splice(2) call. It is the default capacity of a pipe.
+const pipeSize = 64 * 1024
+
+// pipe is the pair of pipe fds used to move data between sockets with splice(2).
+type pipe struct {
+	r, w int
+	// n is the number of bytes in the pipe which are not written to B-leg yet.
+	n int
+}
+
+// pipePool keeps free (empty) pipes, so pipes are not created for every relay.
+type pipePool struct {
+	pipes chan *pipe
+}
+
+func newPipePool(size int) (*pipePool, error) {
+	return &pipePool{
+		pipes: make(chan *pipe, size),
+	}, nil
+}
+
+// get returns a free pipe or creates a new one.
+func (p *pipePool) get() (*pipe, error) {
+	select {
+	case pp := <-p.pipes:
+		return pp, nil
+	default:
+	}
+	var fds [2]int
+	if err := unix.Pipe2(fds[:], unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+		return nil, errors.Wrap(err, "Pipe2()")
+	}
+	return &pipe{r: fds[0], w: fds[1]}, nil
+}
+
+// put returns the pipe to the pool. The pipe is closed if it is not empty or the pool is full.
+func (p *pipePool) put(pp *pipe) {
+	if pp.n != 0 {
+		pp.close()
+		return
+	}
+	select {
+	case p.pipes <- pp:
+	default:
+		pp.close()
+	}
+}
+
+// close closes all free pipes.
+func (p *pipePool) close() {
+	for {
+		select {
+		case pp := <-p.pipes:
+			pp.close()
+		default:
+			return
+		}
+	}
+}
+
+func (pp *pipe) close() {
+	unix.Close(pp.r)
+	unix.Close(pp.w)
+}
+
+// serveSplice is serve for splice relay mode. Data is moved A-leg -> pipe -> B-leg without copying to user space.
+// The pipe is kept by the stalled connection like buffer of serve.
+func (c *PipedConn) serveSplice() error {
+	pp := c.pipe
+	c.pipe = nil
+	if pp == nil {
+		var err error
+		if pp, err = c.pipes.get(); err != nil {
+			return err
+		}
+	}
+
+	err := c.flush(pp)
+	if err == nil {
+		err = c.splice(pp)
+	}
+
+	if !errors.Is(err, errStalled) {
+		c.pipes.put(pp)
+	}
+	if err != nil {
+		return err
+	}
+	return c.reactor.rearm(c.fd)
+}
+
+// splice moves data from A-leg to the pipe until EAGAIN and flushes the pipe to B-leg.
+// The pipe is empty before every reading, so EAGAIN means that A-leg has no data.
+func (c *PipedConn) splice(pp *pipe) error {
+	for {
+		n, err := unix.Splice(c.fd, nil, pp.w, nil, pipeSize, unix.SPLICE_F_NONBLOCK|unix.SPLICE_F_MOVE)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			if err == unix.EAGAIN {
+				return nil
+			}
+			return errors.Wrap(err, "Splice()")
+		}
+		if n == 0 {
+			return io.EOF
+		}
+		pp.n += int(n)
+		if err := c.flush(pp); err != nil {
+			return err
+		}
+	}
+}
+
+// flush moves data from the pipe to B-leg. If B-leg can't accept all data, the connection is stalled with the pipe.
+func (c *PipedConn) flush(pp *pipe) error {
+	for pp.n > 0 {
+		n, err := unix.Splice(pp.r, nil, c.pipeTo.fd, nil, pp.n, unix.SPLICE_F_NONBLOCK|unix.SPLICE_F_MOVE)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			if err == unix.EAGAIN {
+				c.pipe = pp
+				return c.stall(nil, nil)
+			}
+			return errors.Wrap(err, "Splice()")
+		}
+		pp.n -= int(n)
+	}
+	return nil
+}
+
+// releasePipe closes the pipe of the stalled connection. It is called when the finalized pair is released,
+// because the stalled connection is not served anymore.
+func (c *PipedConn) releasePipe() {
+	if c.pipes == nil || !c.stalled.CompareAndSwap(true, false) {
+		return
+	}
+	if c.pipe != nil {
+		c.pipe.close()
+		c.pipe = nil
+	}
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// StickyEntry is the entry of the sticky table of the app.
+type StickyEntry struct {
+	Client   string
+	Backend  string
+	LastSeen time.Time
+}
+
+// stickyTable maps client IPs to chosen backends. Entries expire after ttl without new connections of the client.
+// The table keeps at most maxSize entries, the least recently used entry is evicted first.
+type stickyTable struct {
+	ttl     time.Duration
+	maxSize int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru is the list of *stickyEntry, the most recently used entry is at the front.
+	lru *list.List
+}
+
+type stickyEntry struct {
+	client   string
+	bnd      *backend
+	lastSeen time.Time
+}
+
+func newStickyTable(ttl time.Duration, maxSize int) *stickyTable {
+	return &stickyTable{
+		ttl:     ttl,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// clientIP returns the key of the client in sticky tables.
+func clientIP(client net.Addr) string {
+	if tcpAddr, ok := client.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	return client.String()
+}
+
+// get returns the backend of the client or nil. The entry is refreshed.
+func (t *stickyTable) get(client string, now time.Time) *backend {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(now)
+	elem, ok := t.entries[client]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*stickyEntry)
+	entry.lastSeen = now
+	t.lru.MoveToFront(elem)
+	return entry.bnd
+}
+
+// set sets the backend of the client. It evicts the least recently used entries if the table is full.
+func (t *stickyTable) set(client string, bnd *backend, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if elem, ok := t.entries[client]; ok {
+		entry := elem.Value.(*stickyEntry)
+		entry.bnd = bnd
+		entry.lastSeen = now
+		t.lru.MoveToFront(elem)
+		return
+	}
+	t.entries[client] = t.lru.PushFront(&stickyEntry{
+		client:   client,
+		bnd:      bnd,
+		lastSeen: now,
+	})
+	for t.lru.Len() > t.maxSize {
+		t.remove(t.lru.Back())
+	}
+}
+
+// expire removes expired entries. They are at the back of lru. mu must be held by the caller.
+func (t *stickyTable) expire(now time.Time) {
+	for elem := t.lru.Back(); elem != nil; elem = t.lru.Back() {
+		if now.Sub(elem.Value.(*stickyEntry).lastSeen) < t.ttl {
+			return
+		}
+		t.remove(elem)
+	}
+}
+
+// remove removes the entry. mu must be held by the caller.
+func (t *stickyTable) remove(elem *list.Element) {
+	t.lru.Remove(elem)
+	delete(t.entries, elem.Value.(*stickyEntry).client)
+}
+
+// list returns not expired entries from the most recently used one.
+func (t *stickyTable) list(now time.Time) []StickyEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(now)
+	entries := make([]StickyEntry, 0, t.lru.Len())
+	for elem := t.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*stickyEntry)
+		entries = append(entries, StickyEntry{
+			Client:   entry.client,
+			Backend:  entry.bnd.addr,
+			LastSeen: entry.lastSeen,
+		})
+	}
+	return entries
+}
+
+// clear removes the entry of the client, or all entries if client is empty. It returns the number of removed entries.
+func (t *stickyTable) clear(client string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if client == "" {
+		n := t.lru.Len()
+		t.entries = make(map[string]*list.Element)
+		t.lru.Init()
+		return n
+	}
+	elem, ok := t.entries[client]
+	if !ok {
+		return 0
+	}
+	t.remove(elem)
+	return 1
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStickyTable(t *testing.T) {
+	bnds := newTestBackends(t, []int{1, 1}, nil)
+	start := time.Unix(1700000000, 0)
+	type op struct {
+		// set sets the backend bnd of the client, otherwise the backend of the client is got
+		set    bool
+		client string
+		bnd    int
+		after  time.Duration
+		// want is the index of the got backend, -1 means no backend
+		want int
+	}
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		maxSize int
+		ops     []op
+		// wantClients are listed clients from the most recently used one after all ops
+		wantClients []string
+	}{
+		{
+			name: "get", ttl: time.Minute, maxSize: 10,
+			ops: []op{
+				{set: true, client: "a", bnd: 1},
+				{client: "a", want: 1},
+				{client: "b", want: -1},
+			},
+			wantClients: []string{"a"},
+		},
+		{
+			name: "set replaces backend", ttl: time.Minute, maxSize: 10,
+			ops: []op{
+				{set: true, client: "a", bnd: 0},
+				{set: true, client: "a", bnd: 1},
+				{client: "a", want: 1},
+			},
+			wantClients: []string{"a"},
+		},
+		{
+			name: "idle entry expires", ttl: time.Minute, maxSize: 10,
+			ops: []op{
+				{set: true, client: "a", bnd: 0},
+				{set: true, client: "b", bnd: 1, after: 30 * time.Second},
+				{client: "a", after: 30 * time.Second, want: -1},
+				{client: "b", want: 1},
+			},
+			wantClients: []string{"b"},
+		},
+		{
+			name: "get refreshes entry", ttl: time.Minute, maxSize: 10,
+			ops: []op{
+				{set: true, client: "a", bnd: 0},
+				{client: "a", after: 50 * time.Second, want: 0},
+				{client: "a", after: 50 * time.Second, want: 0},
+			},
+			wantClients: []string{"a"},
+		},
+		{
+			name: "least recently used is evicted", ttl: time.Minute, maxSize: 2,
+			ops: []op{
+				{set: true, client: "a", bnd: 0},
+				{set: true, client: "b", bnd: 1},
+				{client: "a", want: 0},
+				{set: true, client: "c", bnd: 1},
+				{client: "b", want: -1},
+			},
+			wantClients: []string{"c", "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := newStickyTable(tt.ttl, tt.maxSize)
+			now := start
+			for i, o := range tt.ops {
+				now = now.Add(o.after)
+				if o.set {
+					table.set(o.client, bnds[o.bnd], now)
+					continue
+				}
+				if got := backendIndex(bnds, table.get(o.client, now)); got != o.want {
+					t.Fatalf("op %d: get(%q) = %d, want %d", i, o.client, got, o.want)
+				}
+			}
+			entries := table.list(now)
+			if len(entries) != len(tt.wantClients) {
+				t.Fatalf("list() = %v, want clients %v", entries, tt.wantClients)
+			}
+			for i, entry := range entries {
+				if entry.Client != tt.wantClients[i] {
+					t.Errorf("list() = %v, want clients %v", entries, tt.wantClients)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestStickyTableClear(t *testing.T) {
+	bnds := newTestBackends(t, []int{1}, nil)
+	now := time.Unix(1700000000, 0)
+	table := newStickyTable(time.Minute, 10)
+	for _, client := range []string{"a", "b", "c"} {
+		table.set(client, bnds[0], now)
+	}
+	if n := table.clear("b"); n != 1 {
+		t.Errorf("clear(b) = %d, want 1", n)
+	}
+	if n := table.clear("b"); n != 0 {
+		t.Errorf("clear(b) again = %d, want 0", n)
+	}
+	if table.get("b", now) != nil {
+		t.Error("cleared client b has the backend")
+	}
+	if n := table.clear(""); n != 2 {
+		t.Errorf("clear() = %d, want 2", n)
+	}
+	if entries := table.list(now); len(entries) != 0 {
+		t.Errorf("list() after clear() = %v, want empty", entries)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		client net.Addr
+		want   string
+	}{
+		{client: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}, want: "10.0.0.1"},
+		{client: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}, want: "2001:db8::1"},
+		{client: &net.UnixAddr{Name: "/run/client.sock", Net: "unix"}, want: "/run/client.sock"},
+	}
+	for _, tt := range tests {
+		if got := clientIP(tt.client); got != tt.want {
+			t.Errorf("clientIP(%s) = %q, want %q", tt.client, got, tt.want)
+		}
+	}
+}
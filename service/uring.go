@@ -0,0 +1,29 @@
+//go:build !linux
+
+package service
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// uringRelay stub for non-linux envs. io_uring works only in Linux systems.
+type uringRelay struct {
+}
+
+func newUringRelay(ctx context.Context, logger *zerolog.Logger) (*uringRelay, error) {
+	return nil, errors.New("it works only in Linux systems")
+}
+
+func (u *uringRelay) Close() error {
+	return nil
+}
+
+func (u *uringRelay) addPair(conn *PipedConn, rConn *PipedConn) {
+}
+
+func (u *uringRelay) run(listenFd int, onAccept func(fd int)) error {
+	return nil
+}
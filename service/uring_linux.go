@@ -0,0 +1,439 @@
+//go:build linux
+
+package service
+
+import (
+	"context"
+	"sync"
+	"unsafe"
+
+	"github.com/hotafrika/tcp_proxy_epoll/pkg/uring"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	uringEntries   = 1024
+	uringCQEntries = 4096
+	// uringBufCount is the number of provided buffers (power of 2). All buffers are in one fixed buffer.
+	uringBufCount = 1024
+	uringBufSize  = 4 * 1024
+	uringBufGroup = 0
+	// uringMaxQueued is the number of received, but not sent buffers of the leg, after which receiving is paused.
+	uringMaxQueued = 8
+)
+
+// io_uring requests user data is: pair id << 8 | leg index << 4 | operation.
+const (
+	uringOpWake = iota + 1
+	uringOpAccept
+	uringOpRecv
+	uringOpSend
+	uringOpCancel
+)
+
+// uringRelay is the io_uring reactor of the frontend. It accepts new connections with multishot accept,
+// and relays data of both legs with multishot recv into provided buffers and writes from the fixed buffer.
+// All requests are submitted and completed by the run goroutine, so the relay state needs no locks.
+type uringRelay struct {
+	ctx     context.Context
+	logger  *zerolog.Logger
+	ring    *uring.Ring
+	bufRing *uring.BufRing
+	// bufs is the memory of provided buffers. It is registered as the fixed buffer 0.
+	bufs    []byte
+	wakeFd  int
+	wakeBuf []byte
+	// err is the io_uring failure. run exits when it is set.
+	err error
+
+	// mu protects inbox of pairs added by other goroutines and wakeFd from usage after Close.
+	mu     sync.Mutex
+	inbox  []*uringPair
+	closed bool
+
+	pairs   map[uint64]*uringPair
+	nextID  uint64
+	starved []*uringLeg
+}
+
+// uringPair is the pair of legs of one proxied connection.
+type uringPair struct {
+	id   uint64
+	legs [2]*uringLeg
+	// inflight is the number of recv and send requests which are not completed yet.
+	inflight int
+	closing  bool
+}
+
+// uringLeg relays data from A-leg to B-leg of PipedConn.
+type uringLeg struct {
+	pair      *uringPair
+	idx       uint64
+	conn      *PipedConn
+	queue     []uringChunk
+	recving   bool
+	canceling bool
+	eof       bool
+}
+
+// uringChunk is the received data which is not sent yet.
+type uringChunk struct {
+	bid  uint16
+	data []byte
+}
+
+func newUringRelay(ctx context.Context, logger *zerolog.Logger) (*uringRelay, error) {
+	u := &uringRelay{
+		ctx:    ctx,
+		logger: logger,
+		wakeFd: -1,
+		pairs:  make(map[uint64]*uringPair),
+	}
+	err := u.init()
+	if err != nil {
+		u.Close()
+		return nil, err
+	}
+	return u, nil
+}
+
+// init creates io_uring and registers buffers.
+func (u *uringRelay) init() error {
+	var err error
+	u.ring, err = uring.New(uringEntries, uringCQEntries)
+	if err != nil {
+		return errors.Wrap(err, "uring.New()")
+	}
+
+	// buffers are mapped outside of Go heap, because the kernel uses them asynchronously
+	u.bufs, err = unix.Mmap(-1, 0, uringBufCount*uringBufSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANONYMOUS|unix.MAP_PRIVATE)
+	if err != nil {
+		return errors.Wrap(err, "Mmap() buffers")
+	}
+	err = u.ring.RegisterBuffer(u.bufs)
+	if err != nil {
+		return errors.Wrap(err, "RegisterBuffer()")
+	}
+	u.bufRing, err = u.ring.RegisterBufRing(uringBufCount, uringBufGroup)
+	if err != nil {
+		return errors.Wrap(err, "RegisterBufRing()")
+	}
+	for bid := 0; bid < uringBufCount; bid++ {
+		u.bufRing.Add(unsafe.Pointer(&u.buf(uint16(bid))[0]), uringBufSize, uint16(bid))
+	}
+	u.bufRing.Advance()
+
+	u.wakeBuf, err = unix.Mmap(-1, 0, unix.Getpagesize(), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANONYMOUS|unix.MAP_PRIVATE)
+	if err != nil {
+		return errors.Wrap(err, "Mmap() wake buffer")
+	}
+	// eventfd is blocking, so io_uring waits for its readiness
+	u.wakeFd, err = unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		return errors.Wrap(err, "Eventfd()")
+	}
+	return nil
+}
+
+// Close closes io_uring and frees buffers. It must be called after run exit.
+func (u *uringRelay) Close() error {
+	u.mu.Lock()
+	u.closed = true
+	u.mu.Unlock()
+
+	var err error
+	if u.ring != nil {
+		err = u.ring.Close()
+	}
+	if u.bufRing != nil {
+		u.bufRing.Free()
+	}
+	if u.bufs != nil {
+		_ = unix.Munmap(u.bufs)
+	}
+	if u.wakeBuf != nil {
+		_ = unix.Munmap(u.wakeBuf)
+	}
+	if u.wakeFd >= 0 {
+		_ = unix.Close(u.wakeFd)
+	}
+	return err
+}
+
+// addPair passes the connection pair to the run goroutine, which starts relaying data.
+func (u *uringRelay) addPair(conn *PipedConn, rConn *PipedConn) {
+	pair := &uringPair{}
+	pair.legs[0] = &uringLeg{pair: pair, idx: 0, conn: conn}
+	pair.legs[1] = &uringLeg{pair: pair, idx: 1, conn: rConn}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		conn.pair.finalizeOnce.Do(conn.finalize)
+		return
+	}
+	u.inbox = append(u.inbox, pair)
+	u.wake()
+}
+
+// wake interrupts waiting of the run goroutine. mu must be held by the caller.
+func (u *uringRelay) wake() {
+	if u.closed {
+		return
+	}
+	var b [8]byte
+	b[0] = 1
+	_, _ = unix.Write(u.wakeFd, b[:])
+}
+
+// run is a blocking function. It accepts connections of the listener and relays data until ctx is done.
+// onAccept is called for every accepted fd in the run goroutine, so it must not block.
+func (u *uringRelay) run(listenFd int, onAccept func(fd int)) error {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-u.ctx.Done():
+			u.mu.Lock()
+			u.wake()
+			u.mu.Unlock()
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	u.submitWakeRead()
+	u.submitAccept(listenFd)
+	for {
+		if u.err != nil {
+			return u.err
+		}
+		if _, err := u.ring.Submit(1); err != nil {
+			return err
+		}
+		for cqe := u.ring.PeekCQE(); cqe != nil; cqe = u.ring.PeekCQE() {
+			c := *cqe
+			u.ring.SeenCQE()
+			u.complete(c, listenFd, onAccept)
+		}
+		if u.ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// complete handles the completion of the request.
+func (u *uringRelay) complete(c uring.CQE, listenFd int, onAccept func(fd int)) {
+	switch c.UserData & 0xf {
+	case uringOpWake:
+		u.serveInbox()
+		u.submitWakeRead()
+	case uringOpAccept:
+		if c.Res >= 0 {
+			onAccept(int(c.Res))
+		} else {
+			u.logger.Info().Err(unix.Errno(-c.Res)).Msg("io_uring accept")
+		}
+		if !c.More() && u.ctx.Err() == nil {
+			u.submitAccept(listenFd)
+		}
+	case uringOpRecv, uringOpSend:
+		pair := u.pairs[c.UserData>>8]
+		if pair == nil {
+			return
+		}
+		leg := pair.legs[(c.UserData>>4)&0xf]
+		if c.UserData&0xf == uringOpRecv {
+			u.completeRecv(leg, c)
+		} else {
+			u.completeSend(leg, c)
+		}
+		if pair.closing && pair.inflight == 0 {
+			u.release(pair)
+		}
+	}
+}
+
+// completeRecv queues received data for sending to B-leg.
+func (u *uringRelay) completeRecv(leg *uringLeg, c uring.CQE) {
+	if !c.More() {
+		leg.recving = false
+		leg.canceling = false
+		leg.pair.inflight--
+	}
+
+	switch {
+	case c.Res > 0:
+		if leg.pair.closing {
+			u.recycle(c.BufferID())
+			return
+		}
+		leg.queue = append(leg.queue, uringChunk{bid: c.BufferID(), data: u.buf(c.BufferID())[:c.Res]})
+		if len(leg.queue) == 1 {
+			u.submitSend(leg)
+		}
+		if len(leg.queue) >= uringMaxQueued && leg.recving && !leg.canceling {
+			// B-leg is slow, so receiving is paused until the queue is sent
+			leg.canceling = true
+			u.submitCancel(leg)
+		}
+		u.rearm(leg)
+	case c.Res == 0:
+		leg.eof = true
+		if len(leg.queue) == 0 {
+			u.closePair(leg.pair)
+		}
+	case unix.Errno(-c.Res) == unix.ENOBUFS:
+		u.starved = append(u.starved, leg)
+	case unix.Errno(-c.Res) == unix.ECANCELED:
+		// the queue may be sent before the cancellation completes
+		u.rearm(leg)
+	default:
+		u.logger.Info().Err(unix.Errno(-c.Res)).Msgf("can't receive data %s -> %s", leg.conn.RemoteAddr().String(), leg.conn.LocalAddr().String())
+		u.closePair(leg.pair)
+	}
+}
+
+// completeSend sends the rest of the queue and recycles sent buffers.
+func (u *uringRelay) completeSend(leg *uringLeg, c uring.CQE) {
+	leg.pair.inflight--
+	if leg.pair.closing {
+		return
+	}
+	if c.Res <= 0 {
+		u.logger.Info().Err(unix.Errno(-c.Res)).Msgf("can't send data %s -> %s", leg.conn.pipeTo.LocalAddr().String(), leg.conn.pipeTo.RemoteAddr().String())
+		u.closePair(leg.pair)
+		return
+	}
+
+	chunk := &leg.queue[0]
+	chunk.data = chunk.data[c.Res:]
+	if len(chunk.data) == 0 {
+		u.recycle(chunk.bid)
+		leg.queue = leg.queue[1:]
+	}
+	if len(leg.queue) > 0 {
+		u.submitSend(leg)
+		return
+	}
+	if leg.eof {
+		u.closePair(leg.pair)
+		return
+	}
+	u.rearm(leg)
+}
+
+// rearm starts multishot recv of the leg if it is not active and the leg can accept more data.
+func (u *uringRelay) rearm(leg *uringLeg) {
+	if leg.recving || leg.eof || leg.pair.closing || len(leg.queue) >= uringMaxQueued {
+		return
+	}
+	u.submitRecv(leg)
+}
+
+// serveInbox starts relaying of added pairs.
+func (u *uringRelay) serveInbox() {
+	u.mu.Lock()
+	inbox := u.inbox
+	u.inbox = nil
+	u.mu.Unlock()
+
+	for _, pair := range inbox {
+		u.nextID++
+		pair.id = u.nextID
+		u.pairs[pair.id] = pair
+		u.rearm(pair.legs[0])
+		u.rearm(pair.legs[1])
+	}
+}
+
+// closePair shuts down both legs, so all in-flight requests of the pair complete soon.
+func (u *uringRelay) closePair(pair *uringPair) {
+	if pair.closing {
+		return
+	}
+	pair.closing = true
+	for _, leg := range pair.legs {
+		_ = unix.Shutdown(leg.conn.fd, unix.SHUT_RDWR)
+	}
+}
+
+// release recycles buffers of the pair without in-flight requests and finalizes its connections.
+func (u *uringRelay) release(pair *uringPair) {
+	delete(u.pairs, pair.id)
+	for _, leg := range pair.legs {
+		for _, chunk := range leg.queue {
+			u.recycle(chunk.bid)
+		}
+		leg.queue = nil
+	}
+
+	conn := pair.legs[0].conn
+	conn.pair.finalizeOnce.Do(func() {
+		u.logger.Debug().Msgf("closing connection %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
+		u.logger.Debug().Msgf("closing connection %s -> %s", conn.pipeTo.LocalAddr().String(), conn.pipeTo.RemoteAddr().String())
+		conn.finalize()
+	})
+}
+
+// buf returns the provided buffer by its id.
+func (u *uringRelay) buf(bid uint16) []byte {
+	offset := int(bid) * uringBufSize
+	return u.bufs[offset : offset+uringBufSize]
+}
+
+// recycle returns the buffer to the kernel and rearms legs which were starved of buffers.
+func (u *uringRelay) recycle(bid uint16) {
+	u.bufRing.Add(unsafe.Pointer(&u.buf(bid)[0]), uringBufSize, bid)
+	u.bufRing.Advance()
+
+	starved := u.starved
+	u.starved = nil
+	for _, leg := range starved {
+		u.rearm(leg)
+	}
+}
+
+// sqe returns the next SQE. If io_uring fails, the error is kept, and run exits after the current completions.
+func (u *uringRelay) sqe() *uring.SQE {
+	sqe, err := u.ring.SQE()
+	if err != nil {
+		u.err = err
+		return &uring.SQE{}
+	}
+	return sqe
+}
+
+func (u *uringRelay) submitWakeRead() {
+	u.sqe().PrepRead(u.wakeFd, u.wakeBuf[:8], uringOpWake)
+}
+
+func (u *uringRelay) submitAccept(listenFd int) {
+	u.sqe().PrepMultishotAccept(listenFd, uringOpAccept)
+}
+
+func (u *uringRelay) submitRecv(leg *uringLeg) {
+	u.sqe().PrepMultishotRecv(leg.conn.fd, uringBufGroup, leg.userData(uringOpRecv))
+	leg.recving = true
+	leg.pair.inflight++
+}
+
+func (u *uringRelay) submitSend(leg *uringLeg) {
+	u.sqe().PrepWriteFixed(leg.conn.pipeTo.fd, leg.queue[0].data, 0, leg.userData(uringOpSend))
+	leg.pair.inflight++
+}
+
+func (u *uringRelay) submitCancel(leg *uringLeg) {
+	u.sqe().PrepCancel(leg.userData(uringOpRecv), leg.userData(uringOpCancel))
+}
+
+// userData returns user data of the leg request.
+func (l *uringLeg) userData(op uint64) uint64 {
+	return l.pair.id<<8 | l.idx<<4 | op
+}